@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/albertrdixon/gearbox/logger"
+)
+
+var fullSHA = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// approval is an operator's go ahead for an update with --approval=manual.
+type approval struct {
+	SHA string    `json:"sha"`
+	At  time.Time `json:"at"`
+}
+
+func manualApproval() bool {
+	return *approvalMode == "manual"
+}
+
+// approvedTarget returns the sha an update may move to: target without manual
+// approval, else the approved sha once it is upstream. Until then the update
+// to target is recorded as pending and sha is returned.
+func approvedTarget(target, up string) string {
+	if !manualApproval() {
+		if held.Pending != nil || held.Approved != nil {
+			held.Pending, held.Approved = nil, nil
+			saveHold()
+		}
+		return target
+	}
+
+	if a := held.Approved; a != nil {
+		switch {
+		case time.Since(a.At) > *approvalTTL:
+			logEvent("warn", "approval_expired", "Approval of %s expired after %v", short(a.SHA), *approvalTTL)
+			held.Approved = nil
+			saveHold()
+		case isAncestor(a.SHA, sha):
+			held.Approved = nil
+			saveHold()
+		case isAncestor(a.SHA, up):
+			return a.SHA
+		default:
+			logger.Infof("Approved %s is not upstream yet", short(a.SHA))
+		}
+	}
+
+	if target == sha {
+		return sha
+	}
+	if p := held.Pending; p != nil && p.Head == sha && p.Upstream == target {
+		p.Checked = time.Now()
+		saveHold()
+		return sha
+	}
+	commits, er := commitRange(sha, target)
+	if er != nil {
+		logger.Warnf("Unable to list commits %s..%s: %v", short(sha), short(target), er)
+	}
+	held.Pending = &pending{Head: sha, Upstream: target, Commits: commits, Checked: time.Now()}
+	saveHold()
+	logEvent("info", eventUpdatePending, "Update of %s to %s (%d commits) waiting for approval", *name, short(target), len(commits))
+	for _, c := range commits {
+		logger.Infof("  %s %s %s: %s", short(c.SHA), c.Date.Format("2006-01-02"), c.Author, c.Subject)
+	}
+	notify(eventUpdatePending, sha, target, commits, nil)
+	return sha
+}
+
+// settleApproval drops the pending update and approval head has caught up
+// with.
+func settleApproval(head string) {
+	changed := false
+	if p := held.Pending; p != nil && isAncestor(p.Upstream, head) {
+		held.Pending, changed = nil, true
+	}
+	if a := held.Approved; a != nil && isAncestor(a.SHA, head) {
+		held.Approved, changed = nil, true
+	}
+	if changed {
+		saveHold()
+	}
+}
+
+// approve lets the update to rev, the pending one by default, go ahead and
+// applies it right away if it is upstream. A full sha not fetched yet is
+// approved for when it shows up, until --approval-ttl runs out.
+func (s *supervisor) approve(rev string) (bool, error) {
+	if !manualApproval() {
+		return false, errors.New("updates do not need approval")
+	}
+	if rev == "" {
+		if held.Pending == nil {
+			return false, errors.New("no update pending")
+		}
+		rev = held.Pending.Upstream
+	}
+	full, er := gitOutput("rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	if er != nil {
+		if !fullSHA.MatchString(rev) {
+			return false, fmt.Errorf("unknown revision %q", rev)
+		}
+		full = rev
+	}
+	if isAncestor(full, sha) {
+		return false, fmt.Errorf("%s is already deployed", short(full))
+	}
+
+	logEvent("info", "approve", "Approved update of %v to %s", s.app, short(full))
+	held.Approved = &approval{SHA: full, At: time.Now()}
+	if er := held.save(); er != nil {
+		return false, er
+	}
+	return s.update()
+}
+
+func isAncestor(a, b string) bool {
+	_, er := gitOutput("merge-base", "--is-ancestor", a, b)
+	return er == nil
+}
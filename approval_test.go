@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApprovedTarget(t *testing.T) {
+	base := testRepo(t)
+	first := commitFile(t, "a", "first")
+	second := commitFile(t, "b", "second")
+	sha, held, cfg = base, new(hold), new(command)
+	*approvalTTL = time.Hour
+	defer func() { *approvalMode = "auto" }()
+
+	*approvalMode = "auto"
+	held.Pending = &pending{Upstream: second}
+	if got := approvedTarget(second, second); got != second || held.Pending != nil {
+		t.Errorf("auto: got %s, pending %+v", got, held.Pending)
+	}
+
+	*approvalMode = "manual"
+	if got := approvedTarget(second, second); got != base {
+		t.Errorf("manual: got %s, want %s", got, base)
+	}
+	if p := held.Pending; p == nil || p.Head != base || p.Upstream != second || len(p.Commits) != 2 {
+		t.Fatalf("pending %+v", p)
+	}
+	checked := held.Pending.Checked
+	if got := approvedTarget(second, second); got != base || !held.Pending.Checked.After(checked) {
+		t.Errorf("still pending: got %s, checked %v", got, held.Pending.Checked)
+	}
+
+	held.Approved = &approval{SHA: first, At: time.Now()}
+	if got := approvedTarget(second, second); got != first {
+		t.Errorf("approved: got %s, want %s", got, first)
+	}
+
+	held.Approved = &approval{SHA: first, At: time.Now().Add(-*approvalTTL - time.Minute)}
+	if got := approvedTarget(second, second); got != base || held.Approved != nil {
+		t.Errorf("expired: got %s, approved %+v", got, held.Approved)
+	}
+
+	missing := strings.Repeat("1", 40)
+	held.Approved = &approval{SHA: missing, At: time.Now()}
+	if got := approvedTarget(second, second); got != base || held.Approved == nil {
+		t.Errorf("not upstream yet: got %s, approved %+v", got, held.Approved)
+	}
+
+	sha = first
+	held.Approved = &approval{SHA: first, At: time.Now()}
+	if got := approvedTarget(first, second); got != first || held.Approved != nil {
+		t.Errorf("deployed: got %s, approved %+v", got, held.Approved)
+	}
+}
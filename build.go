@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/albertrdixon/gearbox/logger"
+	"golang.org/x/net/context"
+)
+
+// build installs the app's dependencies the usual way for its project type.
+// Install and paths override the type's commands and dependency files.
+type build struct {
+	Type    string   `json:"type"`
+	Install []string `json:"install"`
+	Paths   []string `json:"paths"`
+	Keep    int      `json:"keep"`
+}
+
+// projectType describes how a kind of project is set up. Types with venv run
+// in a virtualenv escarole manages itself instead of through rules.
+type projectType struct {
+	name    string
+	markers []string
+	deps    []string
+	layout  string
+	install func(dir string) []string
+	venv    bool
+	env     func(dir string, env map[string]string)
+}
+
+var projectTypes = []*projectType{
+	{
+		name:    "python",
+		markers: []string{"requirements.txt", "setup.py", "pyproject.toml"},
+		deps:    []string{"/requirements*.txt", "/setup.py", "/setup.cfg", "/pyproject.toml"},
+		venv:    true,
+		env: func(dir string, env map[string]string) {
+			env["VIRTUAL_ENV"] = venvPath()
+			prependPath(env, path.Join(venvPath(), "bin"))
+		},
+	},
+	{
+		name:    "node",
+		markers: []string{"package.json"},
+		deps:    []string{"/package.json", "/package-lock.json", "/npm-shrinkwrap.json", "/yarn.lock"},
+		layout:  "node_modules",
+		install: func(dir string) []string {
+			switch {
+			case exists(path.Join(dir, "yarn.lock")):
+				return []string{"yarn install --frozen-lockfile"}
+			case exists(path.Join(dir, "package-lock.json")), exists(path.Join(dir, "npm-shrinkwrap.json")):
+				return []string{"npm ci"}
+			}
+			return []string{"npm install"}
+		},
+		env: func(dir string, env map[string]string) {
+			prependPath(env, path.Join(dir, "node_modules", ".bin"))
+		},
+	},
+	{
+		name:    "ruby",
+		markers: []string{"Gemfile"},
+		deps:    []string{"/Gemfile", "/Gemfile.lock"},
+		layout:  "vendor/bundle",
+		install: func(dir string) []string {
+			return []string{"bundle install"}
+		},
+		env: func(dir string, env map[string]string) {
+			env["BUNDLE_PATH"] = path.Join(dir, "vendor", "bundle")
+			env["BUNDLE_GEMFILE"] = path.Join(dir, "Gemfile")
+		},
+	},
+	{
+		name:    "go",
+		markers: []string{"go.mod"},
+		deps:    []string{"/go.mod", "/go.sum", "*.go"},
+		layout:  "bin",
+		install: func(dir string) []string {
+			return []string{"go build -o " + path.Join(dir, "bin") + "/ ."}
+		},
+		env: func(dir string, env map[string]string) {
+			prependPath(env, path.Join(dir, "bin"))
+		},
+	},
+}
+
+func (b *build) validate() error {
+	if b == nil || b.Type == "" || b.Type == "none" || b.Type == "auto" {
+		return nil
+	}
+	for _, t := range projectTypes {
+		if b.Type == t.name {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown project type %q", b.Type)
+}
+
+// detect returns the project type to set up, nil for none.
+func (b *build) detect() (*projectType, error) {
+	if b == nil || b.Type == "" || b.Type == "none" {
+		return nil, nil
+	}
+	dir := path.Join(home, *name)
+	for _, t := range projectTypes {
+		if b.Type == t.name {
+			return t, nil
+		}
+		if b.Type != "auto" {
+			continue
+		}
+		for _, m := range t.markers {
+			if exists(path.Join(dir, m)) {
+				return t, nil
+			}
+		}
+	}
+	if b.Type == "auto" {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown project type %q", b.Type)
+}
+
+// rules returns the install steps as rules triggered by dependency changes.
+func (b *build) rules() []rule {
+	t, er := b.detect()
+	if er != nil || t == nil || t.venv {
+		return nil
+	}
+	cmds, paths := b.Install, b.Paths
+	if len(cmds) < 1 {
+		cmds = t.install(path.Join(home, *name))
+	}
+	if len(paths) < 1 {
+		paths = t.deps
+	}
+	rules := make([]rule, len(cmds))
+	for i, c := range cmds {
+		rules[i] = rule{Paths: paths, Run: c}
+	}
+	return rules
+}
+
+// prepare runs the install steps before the app first starts if their
+// layout is missing or dependencies changed since last.
+func (b *build) prepare(c context.Context, last string) error {
+	t, er := b.detect()
+	if er != nil || t == nil {
+		return er
+	}
+	if t.venv {
+		return syncVenv(b, t, c, sha)
+	}
+	rules := b.rules()
+	if exists(path.Join(home, *name, t.layout)) && last != "" {
+		files, er := changedFiles(last, sha)
+		if er != nil {
+			return er
+		}
+		return runRules(c, rules, files, sha)
+	}
+
+	// Nothing installed yet, every step has to run.
+	logger.Infof("Setting up %s project", t.name)
+	for i := range rules {
+		rules[i].Paths = nil
+	}
+	return runRules(c, rules, nil, sha)
+}
+
+// sync switches a managed virtualenv to head's dependencies.
+func (b *build) sync(c context.Context, head string) error {
+	t, er := b.detect()
+	if er != nil || t == nil || !t.venv {
+		return er
+	}
+	return syncVenv(b, t, c, head)
+}
+
+// venv returns the virtualenv for the checkout of head at dir, "" if the
+// project type has none.
+func (b *build) venv(c context.Context, dir, head string) (string, error) {
+	t, er := b.detect()
+	if er != nil || t == nil || !t.venv {
+		return "", er
+	}
+	return buildVenv(b, t, c, dir, head)
+}
+
+// install readies head's dependencies and runs the rules matching files.
+func install(c context.Context, files []string, head string) error {
+	if er := cfg.Build.sync(c, head); er != nil {
+		return er
+	}
+	return runRules(c, cfg.rules(), files, head)
+}
+
+// env adds the project type's layout to the app env.
+func (b *build) env(env map[string]string) {
+	t, er := b.detect()
+	if er != nil || t == nil {
+		return
+	}
+	t.env(path.Join(home, *name), env)
+}
+
+func prependPath(env map[string]string, dir string) {
+	if p := env["PATH"]; p != "" {
+		env["PATH"] = dir + string(os.PathListSeparator) + p
+		return
+	}
+	env["PATH"] = dir + string(os.PathListSeparator) + "/usr/local/bin:/usr/bin:/bin"
+}
+
+// lookPath finds bin the way the app will, with the app's PATH.
+func lookPath(bin string, env map[string]string) (string, error) {
+	if strings.Contains(bin, "/") {
+		return bin, nil
+	}
+	for _, dir := range strings.Split(env["PATH"], ":") {
+		if p := path.Join(dir, bin); executable(p) {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("%q not found in PATH", bin)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestDetect(t *testing.T) {
+	testRepo(t)
+	dir := path.Join(home, *name)
+
+	if tp, er := (&build{Type: "auto"}).detect(); tp != nil || er != nil {
+		t.Errorf("no markers: got %v, %v", tp, er)
+	}
+	commitFile(t, "package.json", "{}")
+	tp, er := (&build{Type: "auto"}).detect()
+	if er != nil || tp == nil || tp.name != "node" {
+		t.Fatalf("package.json: got %v, %v", tp, er)
+	}
+	if cmds := tp.install(dir); len(cmds) != 1 || cmds[0] != "npm install" {
+		t.Errorf("node install %v", cmds)
+	}
+	commitFile(t, "yarn.lock", "")
+	if cmds := tp.install(dir); len(cmds) != 1 || !strings.HasPrefix(cmds[0], "yarn install") {
+		t.Errorf("yarn install %v", cmds)
+	}
+
+	// An explicit type wins over the markers.
+	if tp, er := (&build{Type: "ruby"}).detect(); er != nil || tp.name != "ruby" {
+		t.Errorf("ruby: got %v, %v", tp, er)
+	}
+	if tp, er := (&build{Type: "none"}).detect(); tp != nil || er != nil {
+		t.Errorf("none: got %v, %v", tp, er)
+	}
+	if er := (&build{Type: "cobol"}).validate(); er == nil {
+		t.Error("unknown type: expected an error")
+	}
+}
+
+func TestBuildRules(t *testing.T) {
+	testRepo(t)
+	b := &build{Type: "ruby"}
+	rules := b.rules()
+	if len(rules) != 1 || rules[0].Run != "bundle install" || len(rules[0].Paths) != 2 {
+		t.Errorf("ruby rules %+v", rules)
+	}
+
+	b = &build{Type: "node", Install: []string{"make deps", "make assets"}, Paths: []string{"/deps.txt"}}
+	rules = b.rules()
+	if len(rules) != 2 || rules[1].Run != "make assets" || rules[1].Paths[0] != "/deps.txt" {
+		t.Errorf("overridden rules %+v", rules)
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	base := testRepo(t)
+	setSHA(base)
+	cfg = new(command)
+	dir := path.Join(home, *name)
+	b := &build{Type: "go", Install: []string{"mkdir -p bin", "touch ran"}, Paths: []string{"/go.mod"}}
+
+	// Without the layout every step runs.
+	if er := b.prepare(context.Background(), base); er != nil {
+		t.Fatal(er)
+	}
+	if !exists(path.Join(dir, "bin")) || !exists(path.Join(dir, "ran")) {
+		t.Fatal("install did not run")
+	}
+
+	// With it only changed dependencies do.
+	os.Remove(path.Join(dir, "ran"))
+	head := commitFile(t, "main.go", "package main")
+	setSHA(head)
+	if er := b.prepare(context.Background(), base); er != nil {
+		t.Fatal(er)
+	}
+	if exists(path.Join(dir, "ran")) {
+		t.Error("install ran without a dependency change")
+	}
+	setSHA(commitFile(t, "go.mod", "module app"))
+	if er := b.prepare(context.Background(), base); er != nil {
+		t.Fatal(er)
+	}
+	if !exists(path.Join(dir, "ran")) {
+		t.Error("install did not run for a go.mod change")
+	}
+}
+
+func TestBuildEnv(t *testing.T) {
+	testRepo(t)
+	env := map[string]string{"PATH": "/usr/bin"}
+	(&build{Type: "node"}).env(env)
+	if want := path.Join(home, *name, "node_modules", ".bin") + ":/usr/bin"; env["PATH"] != want {
+		t.Errorf("PATH = %q, want %q", env["PATH"], want)
+	}
+	env = map[string]string{}
+	(&build{Type: "go"}).env(env)
+	if want := path.Join(home, *name, "bin") + ":/usr/local/bin:/usr/bin:/bin"; env["PATH"] != want {
+		t.Errorf("PATH without one = %q, want %q", env["PATH"], want)
+	}
+	env = map[string]string{}
+	(&build{Type: "ruby"}).env(env)
+	if env["BUNDLE_GEMFILE"] != path.Join(home, *name, "Gemfile") {
+		t.Errorf("ruby env %v", env)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/albertrdixon/gearbox/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultBusyInterval = 30 * time.Second
+	defaultBusyMaxWait  = time.Hour
+	busyTimeout         = 30 * time.Second
+)
+
+// busyCheck tells whether the app is in the middle of something a restart
+// would cut short. The app is busy while http answers anything but 2xx, exec
+// exits non-zero or lock_file exists.
+type busyCheck struct {
+	HTTP     string   `json:"http"`
+	Exec     string   `json:"exec"`
+	LockFile string   `json:"lock_file"`
+	Interval duration `json:"interval"`
+	MaxWait  duration `json:"max_wait"`
+}
+
+// deferral is an update checked out but not restarted on while the app is busy.
+type deferral struct {
+	SHA   string    `json:"sha"`
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+
+	files []string
+	retry <-chan time.Time
+}
+
+func (b *busyCheck) validate() error {
+	if b == nil {
+		return nil
+	}
+	if b.HTTP == "" && strings.TrimSpace(b.Exec) == "" && b.LockFile == "" {
+		return errors.New("no http, exec or lock_file given")
+	}
+	return nil
+}
+
+func (b *busyCheck) interval() time.Duration {
+	if b == nil || b.Interval <= 0 {
+		return defaultBusyInterval
+	}
+	return time.Duration(b.Interval)
+}
+
+func (b *busyCheck) maxWait() time.Duration {
+	if b == nil || b.MaxWait <= 0 {
+		return defaultBusyMaxWait
+	}
+	return time.Duration(b.MaxWait)
+}
+
+// busy returns why the app is busy, "" if it is not.
+func (b *busyCheck) busy(c context.Context) string {
+	if b == nil {
+		return ""
+	}
+	e, er := cfg.Env.compose()
+	if er != nil {
+		logger.Warnf("Unable to compose app env for busy check: %v", er)
+		return ""
+	}
+	env := envMap(e)
+
+	if b.LockFile != "" {
+		f := expand(b.LockFile, env)
+		if !path.IsAbs(f) {
+			f = path.Join(home, *name, f)
+		}
+		if exists(f) {
+			return fmt.Sprintf("%s exists", f)
+		}
+	}
+	if b.HTTP != "" {
+		u := expand(b.HTTP, env)
+		cl := &http.Client{Timeout: busyTimeout}
+		if resp, er := cl.Get(u); er != nil {
+			logger.Debugf("Busy check %s failed, taking the app as idle: %v", u, er)
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				return fmt.Sprintf("%s answered %s", u, resp.Status)
+			}
+		}
+	}
+	if strings.TrimSpace(b.Exec) != "" {
+		r := &rule{Run: b.Exec, Timeout: duration(busyTimeout)}
+		if er := r.run(c, e); er != nil {
+			return fmt.Sprintf("%q: %v", b.Exec, er)
+		}
+	}
+	return ""
+}
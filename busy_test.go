@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestBusy(t *testing.T) {
+	testRepo(t)
+	cfg = new(command)
+	code := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	}))
+	defer srv.Close()
+	lock := path.Join(home, *name, "busy.lock")
+	c := context.Background()
+
+	b := &busyCheck{HTTP: srv.URL, Exec: "test ! -e busy.lock", LockFile: "busy.lock"}
+	if why := b.busy(c); why != "" {
+		t.Errorf("idle app busy: %s", why)
+	}
+	os.WriteFile(lock, nil, 0644)
+	if why := b.busy(c); !strings.Contains(why, "busy.lock exists") {
+		t.Errorf("lock file: got %q", why)
+	}
+	b.LockFile = ""
+	if why := b.busy(c); !strings.Contains(why, "test ! -e busy.lock") {
+		t.Errorf("exec: got %q", why)
+	}
+	os.Remove(lock)
+	code = http.StatusServiceUnavailable
+	if why := b.busy(c); !strings.Contains(why, "503") {
+		t.Errorf("http: got %q", why)
+	}
+	if why := (*busyCheck)(nil).busy(c); why != "" {
+		t.Errorf("no check: got %q", why)
+	}
+}
+
+func TestDeferredUpdate(t *testing.T) {
+	base := testRepo(t)
+	setSHA(base)
+	lock := path.Join(home, *name, "busy.lock")
+	cfg = &command{Busy: &busyCheck{LockFile: lock, Interval: duration(10 * time.Millisecond), MaxWait: duration(time.Hour)}}
+	s, log := testSupervisor(t)
+	head := commitFile(t, "a", "new")
+
+	os.WriteFile(lock, nil, 0644)
+	if ok, er := s.apply(head, nil); ok || er != nil || s.deferred == nil || s.deferred.SHA != head {
+		t.Fatalf("busy app: got %v, %v, deferred %+v", ok, er, s.deferred)
+	}
+	step(t, s)
+	if s.deferred == nil || sha != base {
+		t.Fatalf("still busy: deferred %+v, at %s", s.deferred, sha)
+	}
+
+	os.Remove(lock)
+	step(t, s)
+	if s.deferred != nil || sha != head {
+		t.Fatalf("idle: deferred %+v, at %s", s.deferred, sha)
+	}
+	step(t, s)
+	if shas := startedOn(t, log, 2); shas[1] != head {
+		t.Errorf("started on %v, want %s", shas, head)
+	}
+}
+
+func TestDeferredUpdateOnExit(t *testing.T) {
+	base := testRepo(t)
+	setSHA(base)
+	lock := path.Join(home, *name, "busy.lock")
+	cfg = &command{Busy: &busyCheck{LockFile: lock, Interval: duration(time.Hour), MaxWait: duration(time.Hour)}}
+	s, log := testSupervisor(t)
+	head := commitFile(t, "a", "new")
+
+	os.WriteFile(lock, nil, 0644)
+	s.apply(head, nil)
+	stopApp(t, s)
+	step(t, s)
+	if s.deferred != nil || sha != head || lastDeployed() != head {
+		t.Fatalf("deferred %+v, at %s, deployed %s", s.deferred, sha, lastDeployed())
+	}
+	step(t, s)
+	if shas := startedOn(t, log, 2); shas[1] != head {
+		t.Errorf("started on %v, want %s", shas, head)
+	}
+}
+
+func TestDeferredUpdateMaxWait(t *testing.T) {
+	base := testRepo(t)
+	setSHA(base)
+	lock := path.Join(home, *name, "busy.lock")
+	cfg = &command{Busy: &busyCheck{LockFile: lock, MaxWait: duration(time.Minute)}}
+	s, _ := testSupervisor(t)
+	head := commitFile(t, "a", "new")
+
+	os.WriteFile(lock, nil, 0644)
+	s.deferred = &deferral{SHA: head, Since: time.Now().Add(-time.Hour)}
+	if ok, er := s.apply(head, nil); !ok || er != nil || s.deferred != nil {
+		t.Errorf("past max_wait: got %v, %v, deferred %+v", ok, er, s.deferred)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/albertrdixon/gearbox/logger"
+)
+
+// check validates the setup without cloning or starting anything and
+// returns the exit code.
+func check() int {
+	failed := 0
+	step := func(what string, er error) {
+		if er != nil {
+			failed++
+			logger.Errorf("FAIL %s: %v", what, er)
+			return
+		}
+		logger.Infof("ok   %s", what)
+	}
+
+	c, er := read(*conf)
+	step(fmt.Sprintf("config %s", *conf), er)
+	if er == nil {
+		cfg = c
+		step("command", checkCommand(c))
+		if c.Verify != nil {
+			step("signature keys", c.Verify.check())
+		}
+	}
+
+	step("git binary", findGit())
+	if git != "" {
+		step(fmt.Sprintf("remote %s", remoteURL()), checkRemote())
+	}
+	step(fmt.Sprintf("uid %d gid %d", *uid, *gid), checkUser())
+	step(fmt.Sprintf("home %s", home), checkHome())
+
+	if failed > 0 {
+		logger.Errorf("%d checks failed", failed)
+		return 1
+	}
+	logger.Infof("All checks passed")
+	return 0
+}
+
+// validate checks what decoding the config does not. read runs it, so a bad
+// config stops escarole from starting and a reload keeps the old one.
+func (c *command) validate() error {
+	if strings.TrimSpace(c.Cmd) == "" {
+		return errors.New("no cmd given")
+	}
+	if er := c.Build.validate(); er != nil {
+		return fmt.Errorf("build: %v", er)
+	}
+	if er := c.Clone.validate(); er != nil {
+		return fmt.Errorf("clone: %v", er)
+	}
+	if _, er := c.Limits.wrap([]string{"true"}); er != nil {
+		return fmt.Errorf("limits: %v", er)
+	}
+	for _, t := range c.Templates {
+		if t.Dest == "" {
+			return fmt.Errorf("template %s: no dest given", t.Src)
+		}
+		if _, _, er := t.owner(); er != nil {
+			return fmt.Errorf("template %s: %v", t.Src, er)
+		}
+	}
+	if c.ReloadSignal != "" {
+		if _, er := parseSignal(c.ReloadSignal); er != nil {
+			return fmt.Errorf("reload_signal: %v", er)
+		}
+	}
+	if er := c.ReloadCheck.validate(); er != nil {
+		return fmt.Errorf("reload_check: %v", er)
+	}
+	if er := c.Snapshots.validate(); er != nil {
+		return fmt.Errorf("snapshots: %v", er)
+	}
+	if er := c.Busy.validate(); er != nil {
+		return fmt.Errorf("busy: %v", er)
+	}
+	if er := c.Preflight.validate(); er != nil {
+		return fmt.Errorf("preflight: %v", er)
+	}
+	for i, r := range c.Rules {
+		if er := r.validate(); er != nil {
+			return fmt.Errorf("rule %d: %v", i+1, er)
+		}
+	}
+	for _, n := range c.Notify {
+		switch n.Type {
+		case "webhook", "slack", "mattermost":
+			if n.URL == "" {
+				return fmt.Errorf("%s notification: no url given", n.Type)
+			}
+		case "email":
+			if n.SMTP == "" || n.From == "" || len(n.To) < 1 {
+				return errors.New("email notification: smtp, from and to are required")
+			}
+		default:
+			return fmt.Errorf("unknown notification type %q", n.Type)
+		}
+	}
+	return nil
+}
+
+func checkCommand(c *command) error {
+	e, er := c.Env.compose()
+	if er != nil {
+		return er
+	}
+	cmd := strings.Fields(expand(c.Cmd, envMap(e)))
+	if len(cmd) < 1 {
+		return errors.New("empty command")
+	}
+
+	bin, er := lookPath(cmd[0], envMap(e))
+	if er != nil {
+		if t, _ := c.Build.detect(); t != nil {
+			// The build may be what provides it.
+			logger.Warnf("%v, expecting the %s build to provide it", er, t.name)
+			return nil
+		}
+		return er
+	}
+	if !strings.HasPrefix(bin, path.Join(home, *name)) && !executable(bin) {
+		return fmt.Errorf("%s is not executable", bin)
+	}
+	logger.Debugf("Command resolves to %s", bin)
+	return nil
+}
+
+func executable(p string) bool {
+	fi, er := os.Stat(p)
+	return er == nil && !fi.IsDir() && fi.Mode()&0111 != 0
+}
+
+// checkRemote makes sure the remote (and branch) can be reached with the
+// app user's credentials.
+func checkRemote() error {
+	args := []string{"ls-remote", "--exit-code", remoteURL()}
+	if *branch != "" {
+		args = append(args, *branch)
+	} else {
+		args = append(args, "HEAD")
+	}
+
+	cmd := exec.Command(git, args...)
+	cmd.Dir = "/"
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: *uid, Gid: *gid},
+	}
+	out, er := cmd.CombinedOutput()
+	if er != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%v: %s", er, msg)
+		}
+		return er
+	}
+	return nil
+}
+
+func checkUser() error {
+	if _, er := user.LookupId(strconv.Itoa(int(*uid))); er != nil {
+		logger.Warnf("uid %d has no passwd entry: %v", *uid, er)
+	}
+	if _, er := user.LookupGroupId(strconv.Itoa(int(*gid))); er != nil {
+		logger.Warnf("gid %d has no group entry: %v", *gid, er)
+	}
+	if os.Geteuid() != 0 && (int(*uid) != os.Geteuid() || int(*gid) != os.Getegid()) {
+		return fmt.Errorf("escarole runs as %d:%d and cannot switch to the app user", os.Geteuid(), os.Getegid())
+	}
+	return nil
+}
+
+// checkHome verifies the app user will be able to write below home.
+func checkHome() error {
+	dir := home
+	for {
+		if _, er := os.Stat(dir); er == nil {
+			break
+		}
+		if dir == "/" {
+			return errors.New("no existing parent directory")
+		}
+		dir = path.Dir(dir)
+	}
+	if dir != home {
+		// escarole creates and chowns home itself, it only needs to be root.
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("%s does not exist and escarole is not root", home)
+		}
+		return nil
+	}
+
+	if st, ok := statOwner(home); ok && (st.Uid != *uid || st.Gid != *gid) && os.Geteuid() != 0 {
+		return fmt.Errorf("owned by %d:%d and escarole cannot chown it", st.Uid, st.Gid)
+	}
+
+	if dir := path.Join(home, *name); exists(dir) {
+		if st, ok := statOwner(dir); ok && st.Uid != *uid {
+			return fmt.Errorf("%s exists and is owned by uid %d", dir, st.Uid)
+		}
+	}
+	return nil
+}
+
+// checkUpdate fetches the existing clone and reports what an update would
+// apply, without touching the checkout or the running app.
+func checkUpdate() int {
+	if er := findGit(); er != nil {
+		logger.Errorf("git not found in path: %v", er)
+		return 1
+	}
+	if !exists(path.Join(home, *name, ".git")) {
+		logger.Errorf("No clone of %s in %s", *project, path.Join(home, *name))
+		return 1
+	}
+
+	p, er := pendingUpdate()
+	if er != nil {
+		logger.Errorf("%v", er)
+		return 1
+	}
+	for _, line := range strings.Split(p.String(), "\n") {
+		logger.Infof("%s", line)
+	}
+	return 0
+}
+
+// pending describes an available update.
+type pending struct {
+	Head     string    `json:"head"`
+	Upstream string    `json:"upstream"`
+	Commits  []commit  `json:"commits,omitempty"`
+	Checked  time.Time `json:"checked"`
+}
+
+func (p *pending) String() string {
+	if p.Head == p.Upstream {
+		return fmt.Sprintf("%s is up to date at %s", *name, short(p.Head))
+	}
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, "Update available for %s: %s..%s (%d commits)", *name, short(p.Head), short(p.Upstream), len(p.Commits))
+	for _, c := range p.Commits {
+		fmt.Fprintf(b, "\n  %s %s %s: %s", short(c.SHA), c.Date.Format("2006-01-02"), c.Author, c.Subject)
+	}
+	return b.String()
+}
+
+// pendingUpdate fetches upstream and compares it to HEAD, leaving the
+// checkout alone.
+func pendingUpdate() (*pending, error) {
+	if _, er := gitOutput("remote", "update", "-p"); er != nil {
+		return nil, fmt.Errorf("fetch failed: %v", er)
+	}
+	head, er := gitOutput("rev-parse", "HEAD")
+	if er != nil {
+		return nil, er
+	}
+	up, er := gitOutput("rev-parse", "@{u}")
+	if er != nil {
+		return nil, er
+	}
+
+	p := &pending{Head: head, Upstream: up, Checked: time.Now()}
+	if p.Commits, er = commitRange(head, up); er != nil {
+		return nil, er
+	}
+	return p, nil
+}
+
+func exists(p string) bool {
+	_, er := os.Stat(p)
+	return er == nil
+}
+
+func statOwner(p string) (*syscall.Stat_t, bool) {
+	fi, er := os.Stat(p)
+	if er != nil {
+		return nil, false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return st, ok
+}
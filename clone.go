@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/albertrdixon/gearbox/logger"
+)
+
+// cloneOptions trims what gets cloned for large repositories.
+type cloneOptions struct {
+	Depth      int      `json:"depth"`
+	Filter     string   `json:"filter"`
+	Sparse     []string `json:"sparse"`
+	Submodules *bool    `json:"submodules"`
+}
+
+func (o *cloneOptions) shallow() bool {
+	return o != nil && o.Depth > 0
+}
+
+func (o *cloneOptions) submodules() bool {
+	return o == nil || o.Submodules == nil || *o.Submodules
+}
+
+func (o *cloneOptions) sparse() bool {
+	return o != nil && len(o.Sparse) > 0
+}
+
+// args returns the git clone flags for o.
+func (o *cloneOptions) args() []string {
+	args := []string{"--single-branch", "--progress"}
+	if o.submodules() {
+		args = append(args, "--recursive")
+	}
+	if o == nil {
+		return args
+	}
+	if o.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(o.Depth))
+		if o.submodules() {
+			args = append(args, "--shallow-submodules")
+		}
+	}
+	if o.Filter != "" {
+		args = append(args, "--filter", o.Filter)
+	}
+	if o.sparse() {
+		args = append(args, "--sparse")
+	}
+	return args
+}
+
+func (o *cloneOptions) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.Depth < 0 {
+		return errors.New("depth must not be negative")
+	}
+	if o.Filter != "" && !strings.Contains(o.Filter, ":") {
+		return fmt.Errorf("bad filter %q, e.g. blob:none", o.Filter)
+	}
+	for _, p := range o.Sparse {
+		if strings.TrimSpace(p) == "" {
+			return errors.New("empty sparse path")
+		}
+	}
+	return nil
+}
+
+// applySparse makes the checkout match the configured sparse paths, also
+// for existing clones whose list changed or was dropped.
+func (o *cloneOptions) applySparse() error {
+	if !o.sparse() {
+		if on, _ := gitOutput("config", "--bool", "core.sparseCheckout"); on == "true" {
+			logger.Infof("Disabling sparse checkout")
+			_, er := gitOutput("sparse-checkout", "disable")
+			return er
+		}
+		return nil
+	}
+
+	logger.Infof("Sparse checkout of %s", strings.Join(o.Sparse, ", "))
+	if _, er := gitOutput(append([]string{"sparse-checkout", "set", "--"}, o.Sparse...)...); er != nil {
+		return er
+	}
+	if !o.submodules() {
+		return nil
+	}
+	// Submodules below paths that just came into the checkout are not
+	// initialized by the clone.
+	return o.updateSubmodules()
+}
+
+// updateSubmodules points submodules at the urls in .gitmodules and checks
+// out the commits the superproject records.
+func (o *cloneOptions) updateSubmodules() error {
+	if _, er := gitOutput("submodule", "sync", "--recursive"); er != nil {
+		return fmt.Errorf("submodule sync: %v", er)
+	}
+	args := []string{"submodule", "update", "--init", "--recursive"}
+	if o.shallow() {
+		args = append(args, "--depth", strconv.Itoa(o.Depth))
+	}
+	if _, er := gitOutput(args...); er != nil {
+		return fmt.Errorf("submodule update: %v", er)
+	}
+	return nil
+}
+
+// submoduleState lists the checked out commit of every submodule.
+func submoduleState() string {
+	s, er := gitOutput("submodule", "status", "--recursive")
+	if er != nil {
+		logger.Warnf("Unable to get submodule status: %v", er)
+	}
+	return s
+}
+
+// fastForward moves a shallow clone to target, an upstream commit. Without the
+// full history a merge can fail for want of a merge base, upstream simply
+// wins then. Any other failure is returned as is.
+func fastForward(target string) error {
+	_, er := gitOutput("merge", "--ff-only", target)
+	if er == nil {
+		return nil
+	}
+	if _, mer := gitOutput("merge-base", "HEAD", target); mer == nil || !noMergeBase(mer) {
+		return er
+	}
+	logger.Warnf("No merge base in shallow clone, resetting to upstream: %v", er)
+	_, er = gitOutput("reset", "--hard", target)
+	return er
+}
+
+// noMergeBase tells whether er is git merge-base exiting 1 without a word,
+// which is how it reports that the commits share no history.
+func noMergeBase(er error) bool {
+	var ex *exec.ExitError
+	return errors.As(er, &ex) && ex.ExitCode() == 1
+}
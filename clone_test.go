@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestFastForward(t *testing.T) {
+	base := testRepo(t)
+	up := commitFile(t, "a", "upstream")
+	mustGit(t, "checkout", "-q", base)
+	if er := fastForward(up); er != nil {
+		t.Fatal(er)
+	}
+	if head := mustGit(t, "rev-parse", "HEAD"); head != up {
+		t.Errorf("fast-forward: at %s, want %s", head, up)
+	}
+
+	// Diverged history with a merge base is an error, not a reset.
+	mustGit(t, "checkout", "-q", base)
+	local := commitFile(t, "b", "local")
+	if er := fastForward(up); er == nil {
+		t.Errorf("diverged: expected an error")
+	}
+	if head := mustGit(t, "rev-parse", "HEAD"); head != local {
+		t.Errorf("diverged: moved to %s", head)
+	}
+
+	// Unrelated history, like a shallow clone missing the base, is reset.
+	mustGit(t, "checkout", "-q", "--orphan", "other")
+	commitFile(t, "c", "unrelated")
+	if er := fastForward(up); er != nil {
+		t.Fatal(er)
+	}
+	if head := mustGit(t, "rev-parse", "HEAD"); head != up {
+		t.Errorf("no merge base: at %s, want %s", head, up)
+	}
+}
+
+func TestUpdateSubmodules(t *testing.T) {
+	testRepo(t)
+	app := *name
+
+	// A second repo next to the app serves as the submodule.
+	*name = "lib"
+	if er := os.MkdirAll(path.Join(home, *name), 0755); er != nil {
+		t.Fatal(er)
+	}
+	mustGit(t, "init", "-q", "-b", "master")
+	v1 := commitFile(t, "lib.py", "v1")
+	v2 := commitFile(t, "lib.py", "v2")
+	*name = app
+
+	// Cloning from a local path needs file:// allowed.
+	for k, v := range map[string]string{"GIT_CONFIG_COUNT": "1", "GIT_CONFIG_KEY_0": "protocol.file.allow", "GIT_CONFIG_VALUE_0": "always"} {
+		t.Setenv(k, v)
+	}
+	mustGit(t, "submodule", "add", "-q", path.Join(home, "lib"), "lib")
+	mustGit(t, "-C", "lib", "checkout", "-q", v1)
+	mustGit(t, "commit", "-q", "-am", "lib at v1")
+	old := mustGit(t, "rev-parse", "HEAD")
+	mustGit(t, "-C", "lib", "checkout", "-q", v2)
+	mustGit(t, "commit", "-q", "-am", "lib at v2")
+
+	// Moving the superproject back leaves the submodule alone until it is
+	// updated.
+	mustGit(t, "reset", "-q", "--hard", old)
+	before := submoduleState()
+	if !strings.Contains(before, v2) {
+		t.Fatalf("submodule status %q", before)
+	}
+	if er := new(cloneOptions).updateSubmodules(); er != nil {
+		t.Fatal(er)
+	}
+	if after := submoduleState(); after == before || !strings.Contains(after, v1) {
+		t.Errorf("submodule status %q after update", after)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ghodss/yaml"
+	"gopkg.in/alecthomas/kingpin.v2"
+	yamlv2 "gopkg.in/yaml.v2"
+)
+
+// settings are the flags that can also be set in the config file. Keys are
+// the flag names with underscores and values are parsed like the flag's.
+type settings struct {
+	Branch         *setting `json:"branch"`
+	UpdateInterval *setting `json:"update_interval"`
+	UID            *setting `json:"uid"`
+	GID            *setting `json:"gid"`
+	LogLevel       *setting `json:"log_level"`
+	LogFormat      *setting `json:"log_format"`
+	LogPassthrough *setting `json:"log_passthrough"`
+	LogTarget      *setting `json:"log_target"`
+	SyslogAddr     *setting `json:"syslog_addr"`
+	Socket         *setting `json:"socket"`
+	Pin            *setting `json:"pin"`
+	MinCommitAge   *setting `json:"min_commit_age"`
+	Approval       *setting `json:"approval"`
+	ApprovalTTL    *setting `json:"approval_ttl"`
+}
+
+func (s *settings) flags() map[string]*setting {
+	return map[string]*setting{
+		"branch":          s.Branch,
+		"update-interval": s.UpdateInterval,
+		"uid":             s.UID,
+		"gid":             s.GID,
+		"log-level":       s.LogLevel,
+		"log-format":      s.LogFormat,
+		"log-passthrough": s.LogPassthrough,
+		"log-target":      s.LogTarget,
+		"syslog-addr":     s.SyslogAddr,
+		"socket":          s.Socket,
+		"pin":             s.Pin,
+		"min-commit-age":  s.MinCommitAge,
+		"approval":        s.Approval,
+		"approval-ttl":    s.ApprovalTTL,
+	}
+}
+
+// setting is a flag value from the config, given as any scalar.
+type setting string
+
+func (s *setting) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if er := unmarshalJSON(b, &v); er != nil {
+		return er
+	}
+	switch v.(type) {
+	case string, bool, json.Number:
+		*s = setting(fmt.Sprint(v))
+		return nil
+	}
+	return fmt.Errorf("expected a single value, got %s", b)
+}
+
+// loadConfig reads --config and fills in every flag and arg not given on the
+// command line or through its env var. A missing config is fine here, the
+// commands that need one fail on their own.
+func loadConfig(args []string) error {
+	if _, er := os.Stat(*conf); os.IsNotExist(er) {
+		return nil
+	}
+	c, er := read(*conf)
+	if er != nil {
+		return fmt.Errorf("%s: %v", *conf, er)
+	}
+	cfg = c
+
+	ctx, er := app.ParseContext(args)
+	if er != nil {
+		return er
+	}
+	given := make(map[string]bool)
+	for _, e := range ctx.Elements {
+		if f, ok := e.Clause.(*kingpin.FlagClause); ok {
+			given[f.Model().Name] = true
+		}
+	}
+
+	values := c.flags()
+	for _, f := range app.Model().Flags {
+		v := values[f.Name]
+		if v == nil || given[f.Name] {
+			continue
+		}
+		if _, ok := os.LookupEnv(f.Envar); ok && f.Envar != "" {
+			continue
+		}
+		if er := f.Value.Set(string(*v)); er != nil {
+			return fmt.Errorf("%s: %s: %v", *conf, strings.Replace(f.Name, "-", "_", -1), er)
+		}
+	}
+
+	if *project == "" {
+		*project = c.Project
+	}
+	if *name == "" {
+		*name = c.Name
+	}
+	return nil
+}
+
+// decodeConfig decodes a YAML, JSON or TOML config, picked by extension, into
+// c and rejects keys c has no field for.
+func decodeConfig(file string, body []byte, c *command) error {
+	var (
+		raw interface{}
+		er  error
+	)
+	switch strings.ToLower(path.Ext(file)) {
+	case ".toml":
+		raw, er = decodeTOML(body, reflect.TypeOf(c))
+	case ".json":
+		er = unmarshalJSON(body, &raw)
+	default:
+		var v yamlValue
+		if er = yamlv2.Unmarshal(body, &v); er == nil {
+			raw = v.v
+		}
+	}
+	if er != nil {
+		return er
+	}
+	if er := checkKeys(raw, reflect.TypeOf(c), ""); er != nil {
+		return er
+	}
+
+	// Going through ghodss/yaml lets scalars land in string fields whatever
+	// type the file gave them, JSON being valid YAML.
+	j, er := json.Marshal(raw)
+	if er != nil {
+		return er
+	}
+	return yaml.Unmarshal(j, c)
+}
+
+// yamlOctal matches YAML 1.1 octal literals like 0640.
+var yamlOctal = regexp.MustCompile(`^0o?[0-7]+$`)
+
+// yamlValue decodes YAML into plain maps and slices like ghodss/yaml does,
+// except that octal literals are kept as written. Decoded they would reach
+// fileMode as their decimal value, which then reads its digits as octal.
+type yamlValue struct {
+	v interface{}
+}
+
+func (y *yamlValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if er := unmarshal(&y.v); er != nil {
+		return er
+	}
+	switch y.v.(type) {
+	case map[interface{}]interface{}:
+		var m map[string]yamlValue
+		if er := unmarshal(&m); er != nil {
+			return er
+		}
+		raw := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			raw[k] = v.v
+		}
+		y.v = raw
+	case []interface{}:
+		var l []yamlValue
+		if er := unmarshal(&l); er != nil {
+			return er
+		}
+		raw := make([]interface{}, len(l))
+		for i, v := range l {
+			raw[i] = v.v
+		}
+		y.v = raw
+	case int, int64, uint64:
+		var s string
+		if er := unmarshal(&s); er == nil && yamlOctal.MatchString(s) {
+			y.v = s
+		}
+	}
+	return nil
+}
+
+// decodeTOML decodes a TOML document for t into plain maps and slices, the
+// shape the other formats decode into.
+func decodeTOML(body []byte, t reflect.Type) (interface{}, error) {
+	var m map[string]interface{}
+	if er := toml.Unmarshal(body, &m); er != nil {
+		return nil, er
+	}
+	j, er := json.Marshal(m)
+	if er != nil {
+		return nil, er
+	}
+	var raw interface{}
+	if er := unmarshalJSON(j, &raw); er != nil {
+		return nil, er
+	}
+	return tomlModes(raw, t), nil
+}
+
+var fileModeType = reflect.TypeOf(fileMode(0))
+
+// tomlModes turns the integers in v that decode into a fileMode into octal
+// strings. TOML has octal literals, so 0o640 arrives as 416, which fileMode
+// would otherwise read digit by digit like the 640 YAML and JSON allow.
+func tomlModes(v interface{}, t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == fileModeType {
+		if n, ok := v.(json.Number); ok {
+			if i, er := n.Int64(); er == nil {
+				return "0o" + strconv.FormatInt(i, 8)
+			}
+		}
+		return v
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			switch t.Kind() {
+			case reflect.Map:
+				v[k] = tomlModes(e, t.Elem())
+			case reflect.Struct:
+				if f, ok := field(t, k); ok {
+					v[k] = tomlModes(e, f.Type)
+				}
+			}
+		}
+	case []interface{}:
+		if t.Kind() == reflect.Slice {
+			for i, e := range v {
+				v[i] = tomlModes(e, t.Elem())
+			}
+		}
+	}
+	return v
+}
+
+func unmarshalJSON(b []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+var unmarshaler = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// checkKeys reports the first key in v that has no matching field in t.
+func checkKeys(v interface{}, t reflect.Type, at string) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(unmarshaler) {
+		return nil
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			key := k
+			if at != "" {
+				key = at + "." + k
+			}
+			ft := t
+			switch t.Kind() {
+			case reflect.Map:
+				ft = t.Elem()
+			case reflect.Struct:
+				f, ok := field(t, k)
+				if !ok {
+					return fmt.Errorf("unknown key %q", key)
+				}
+				ft = f.Type
+			default:
+				continue
+			}
+			if er := checkKeys(v[k], ft, key); er != nil {
+				return er
+			}
+		}
+	case []interface{}:
+		if t.Kind() != reflect.Slice {
+			return nil
+		}
+		for i, e := range v {
+			if er := checkKeys(e, t.Elem(), fmt.Sprintf("%s[%d]", at, i)); er != nil {
+				return er
+			}
+		}
+	}
+	return nil
+}
+
+// field finds the field encoding/json would decode key into.
+func field(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			if sf, ok := field(f.Type, key); ok {
+				return sf, true
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		n := strings.Split(f.Tag.Get("json"), ",")[0]
+		if n == "-" {
+			continue
+		}
+		if n == "" {
+			n = f.Name
+		}
+		if strings.EqualFold(n, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestDecodeConfig(t *testing.T) {
+	files := map[string]string{
+		"app.yml": `
+name: app
+cmd: run
+branch: main
+notifications:
+  - type: slack
+    url: http://hook
+rules:
+  - paths: ["*.py"]
+    run: make
+`,
+		"app.json": `{"name": "app", "cmd": "run", "branch": "main",
+  "notifications": [{"type": "slack", "url": "http://hook"}],
+  "rules": [{"paths": ["*.py"], "run": "make"}]}`,
+		"app.toml": `
+name = "app"
+cmd = "run"
+branch = "main"
+
+[[notifications]]
+type = "slack"
+url = "http://hook"
+
+[[rules]]
+paths = ["*.py"]
+run = "make"
+`,
+	}
+	for file, body := range files {
+		c := new(command)
+		if er := decodeConfig(file, []byte(body), c); er != nil {
+			t.Errorf("%s: %v", file, er)
+			continue
+		}
+		if c.Name != "app" || c.Cmd != "run" || c.Branch == nil || *c.Branch != "main" {
+			t.Errorf("%s: got name %q, cmd %q, branch %v", file, c.Name, c.Cmd, c.Branch)
+		}
+		if len(c.Notify) != 1 || c.Notify[0].URL != "http://hook" {
+			t.Errorf("%s: got notifications %+v", file, c.Notify)
+		}
+		if len(c.Rules) != 1 || c.Rules[0].Run != "make" || len(c.Rules[0].Paths) != 1 {
+			t.Errorf("%s: got rules %+v", file, c.Rules)
+		}
+	}
+}
+
+func TestDecodeConfigUnknownKeys(t *testing.T) {
+	tests := []struct {
+		file, body, err string
+	}{
+		{"a.yml", "name: app\ncmnd: run", `unknown key "cmnd"`},
+		{"a.yml", "env:\n  vars: {}\n  secret: []", `unknown key "env.secret"`},
+		{"a.json", `{"notifications": [{"type": "slack"}, {"type": "email", "too": []}]}`, `unknown key "notifications[1].too"`},
+		{"a.toml", "[[rules]]\nrun = \"make\"\npath = \"*.py\"", `unknown key "rules[0].path"`},
+		{"a.toml", "[limits]\nmemroy = \"1G\"", `unknown key "limits.memroy"`},
+		{"a.toml", "name = \"app\"\n[name]", `'name' has already been defined`},
+	}
+	for _, tt := range tests {
+		er := decodeConfig(tt.file, []byte(tt.body), new(command))
+		if er == nil {
+			t.Errorf("%s %q: expected an error", tt.file, tt.body)
+		} else if !strings.Contains(er.Error(), tt.err) {
+			t.Errorf("%s %q: got %q, want %q", tt.file, tt.body, er, tt.err)
+		}
+	}
+}
+
+// The sample config in the README must be usable as is.
+func TestReadmeSample(t *testing.T) {
+	b, er := os.ReadFile("README.md")
+	if er != nil {
+		t.Fatal(er)
+	}
+	s := string(b)
+	i := strings.Index(s, "```yaml\nproject:")
+	if i < 0 {
+		t.Fatal("no sample config in README.md")
+	}
+	s = s[i+len("```yaml\n"):]
+	s = s[:strings.Index(s, "```")]
+
+	c := new(command)
+	if er := decodeConfig("sample.yml", []byte(s), c); er != nil {
+		t.Fatal(er)
+	}
+	if er := c.validate(); er != nil {
+		t.Error(er)
+	}
+	if er := c.Verify.check(); er != nil {
+		t.Error(er)
+	}
+}
+
+func TestReadValidates(t *testing.T) {
+	tests := map[string]string{
+		"no cmd":       "name: app",
+		"notification": "cmd: run\nnotifications:\n  - type: pager\n    url: http://x",
+		"no url":       "cmd: run\nnotifications:\n  - type: slack",
+	}
+	dir := t.TempDir()
+	for what, body := range tests {
+		file := path.Join(dir, "app.yml")
+		os.WriteFile(file, []byte(body), 0644)
+		if _, er := read(file); er == nil {
+			t.Errorf("%s: expected an error", what)
+		}
+	}
+	os.WriteFile(path.Join(dir, "app.yml"), []byte("cmd: run"), 0644)
+	if _, er := read(path.Join(dir, "app.yml")); er != nil {
+		t.Errorf("valid config: %v", er)
+	}
+}
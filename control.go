@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/albertrdixon/gearbox/logger"
+	"golang.org/x/net/context"
+)
+
+const logRingSize = 1000
+
+// control carries requests from the control socket into the supervisor loop.
+var control = make(chan *request)
+
+// recent keeps the latest app output for `escarole logs`.
+var recent = newLogRing(logRingSize)
+
+type request struct {
+	action string
+	args   url.Values
+	reply  chan response
+}
+
+type response struct {
+	OK      bool        `json:"ok"`
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// handle runs a control request inside the supervisor loop.
+func (s *supervisor) handle(req *request) response {
+	switch req.action {
+	case "status":
+		return response{OK: true, Data: s.snapshot()}
+	case "update":
+		if req.args.Get("dry_run") != "" {
+			p, er := pendingUpdate()
+			if er != nil {
+				return response{Message: er.Error()}
+			}
+			return response{OK: true, Message: p.String(), Data: p}
+		}
+		if why := holdReason(); why != "" {
+			return response{Message: fmt.Sprintf("Not updating %s, %s", *name, why)}
+		}
+		updated, er := s.update()
+		if er != nil {
+			return response{Message: er.Error()}
+		}
+		if d := s.deferred; !updated && d != nil {
+			return response{OK: true, Message: fmt.Sprintf("Restart of %s on %s deferred, the app is busy", *name, short(d.SHA))}
+		}
+		if p := held.Pending; !updated && p != nil {
+			return response{OK: true, Message: fmt.Sprintf("Update of %s to %s waiting for approval", *name, short(p.Upstream))}
+		}
+		if !updated {
+			return response{OK: true, Message: fmt.Sprintf("%s is up to date at %s", *name, short(sha))}
+		}
+		return response{OK: true, Message: fmt.Sprintf("Updated %s to %s", *name, short(sha))}
+	case "restart":
+		if d := s.deferred; d != nil {
+			logEvent("info", "restart", "Applying deferred update of %v to %s on request", s.app, short(d.SHA))
+			s.deferred = nil
+			if _, er := s.finish(d.SHA, d.files); er != nil {
+				return response{Message: er.Error()}
+			}
+			return response{OK: true, Message: fmt.Sprintf("Updated %s to %s", *name, short(sha))}
+		}
+		logEvent("info", "restart", "Restarting %v on request", s.app)
+		if er := s.restart(); er != nil {
+			return response{Message: er.Error()}
+		}
+		return response{OK: true, Message: fmt.Sprintf("Restarting %s", *name)}
+	case "rollback":
+		if er := s.rollback(req.args.Get("sha")); er != nil {
+			return response{Message: er.Error()}
+		}
+		return response{OK: true, Message: fmt.Sprintf("Rolled back %s to %s", *name, short(sha))}
+	case "pin":
+		if er := s.pin(req.args.Get("sha")); er != nil {
+			return response{Message: er.Error()}
+		}
+		return response{OK: true, Message: fmt.Sprintf("Pinned %s to %s", *name, short(sha))}
+	case "approve":
+		if why := holdReason(); why != "" {
+			return response{Message: fmt.Sprintf("Not updating %s, %s", *name, why)}
+		}
+		updated, er := s.approve(req.args.Get("sha"))
+		if er != nil {
+			return response{Message: er.Error()}
+		}
+		if d := s.deferred; !updated && d != nil {
+			return response{OK: true, Message: fmt.Sprintf("Approved, restart of %s on %s deferred, the app is busy", *name, short(d.SHA))}
+		}
+		if !updated {
+			return response{OK: true, Message: fmt.Sprintf("Approved, %s stays at %s until the approved sha is upstream", *name, short(sha))}
+		}
+		return response{OK: true, Message: fmt.Sprintf("Updated %s to %s", *name, short(sha))}
+	case "unpin":
+		if er := s.unpin(); er != nil {
+			return response{Message: er.Error()}
+		}
+		return response{OK: true, Message: fmt.Sprintf("Unpinned %s", *name)}
+	case "pause", "resume":
+		if er := s.pause(req.action == "pause"); er != nil {
+			return response{Message: er.Error()}
+		}
+		if held.Paused {
+			return response{OK: true, Message: fmt.Sprintf("Paused updates of %s", *name)}
+		}
+		return response{OK: true, Message: fmt.Sprintf("Resumed updates of %s", *name)}
+	}
+	return response{Message: fmt.Sprintf("unknown action %q", req.action)}
+}
+
+// serveControl answers control requests on the unix socket until c is done.
+func serveControl(c context.Context) {
+	if er := os.MkdirAll(path.Dir(*socket), 0755); er != nil {
+		logger.Errorf("Control socket disabled: %v", er)
+		return
+	}
+	os.Remove(*socket)
+	l, er := net.Listen("unix", *socket)
+	if er != nil {
+		logger.Errorf("Control socket disabled: %v", er)
+		return
+	}
+	if er := os.Chmod(*socket, 0600); er != nil {
+		logger.Warnf("Unable to chmod %s: %v", *socket, er)
+	}
+	go func() {
+		<-c.Done()
+		l.Close()
+		os.Remove(*socket)
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/logs", serveLogs)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		req := &request{
+			action: strings.Trim(r.URL.Path, "/"),
+			args:   r.Form,
+			reply:  make(chan response, 1),
+		}
+		select {
+		case control <- req:
+		case <-c.Done():
+			return
+		}
+		resp := <-req.reply
+		if !resp.OK {
+			w.WriteHeader(http.StatusConflict)
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+
+	logger.Debugf("Listening on %s", *socket)
+	http.Serve(l, mux)
+}
+
+func serveLogs(w http.ResponseWriter, r *http.Request) {
+	n, _ := strconv.Atoi(r.FormValue("n"))
+	for _, line := range recent.tail(n) {
+		io.WriteString(w, line)
+	}
+	if r.FormValue("follow") == "" {
+		return
+	}
+
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return
+	}
+	f.Flush()
+	lines, cancel := recent.subscribe()
+	defer cancel()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case line := <-lines:
+			io.WriteString(w, line)
+			f.Flush()
+		}
+	}
+}
+
+// controlClient talks to a running escarole over its socket.
+func controlClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", *socket)
+			},
+		},
+	}
+}
+
+// callControl sends action to the running escarole, prints its answer and
+// returns the exit code.
+func callControl(action string, args url.Values) int {
+	resp, er := controlClient().PostForm("http://escarole/"+action, args)
+	if er != nil {
+		fmt.Fprintf(os.Stderr, "Unable to reach escarole at %s: %v\n", *socket, er)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	// Keep data raw so status prints in the server's field order.
+	var r struct {
+		response
+		Data json.RawMessage `json:"data"`
+	}
+	if er := json.NewDecoder(resp.Body).Decode(&r); er != nil {
+		fmt.Fprintf(os.Stderr, "Bad response: %v\n", er)
+		return 1
+	}
+	if !r.OK {
+		fmt.Fprintln(os.Stderr, r.Message)
+		return 1
+	}
+	if r.Message != "" {
+		fmt.Println(r.Message)
+	}
+	if action == "status" {
+		b := new(bytes.Buffer)
+		json.Indent(b, r.Data, "", "  ")
+		fmt.Println(b.String())
+	}
+	return 0
+}
+
+func tailLogs(n int, follow bool) int {
+	v := url.Values{"n": {strconv.Itoa(n)}}
+	if follow {
+		v.Set("follow", "1")
+	}
+	resp, er := controlClient().Get("http://escarole/logs?" + v.Encode())
+	if er != nil {
+		fmt.Fprintf(os.Stderr, "Unable to reach escarole at %s: %v\n", *socket, er)
+		return 1
+	}
+	defer resp.Body.Close()
+	if _, er := io.Copy(os.Stdout, resp.Body); er != nil {
+		return 1
+	}
+	return 0
+}
+
+// logRing is an io.Writer keeping the last lines written to it.
+type logRing struct {
+	sync.Mutex
+	lines []string
+	next  int
+	full  bool
+	subs  map[chan string]struct{}
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{lines: make([]string, size), subs: make(map[chan string]struct{})}
+}
+
+func (l *logRing) Write(b []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := s.Text() + "\n"
+		l.lines[l.next] = line
+		l.next = (l.next + 1) % len(l.lines)
+		l.full = l.full || l.next == 0
+		for c := range l.subs {
+			select {
+			case c <- line:
+			default:
+			}
+		}
+	}
+	return len(b), nil
+}
+
+// tail returns the last n lines, all of them if n < 1.
+func (l *logRing) tail(n int) []string {
+	l.Lock()
+	defer l.Unlock()
+
+	var all []string
+	if l.full {
+		all = append(all, l.lines[l.next:]...)
+	}
+	all = append(all, l.lines[:l.next]...)
+	if n > 0 && n < len(all) {
+		all = all[len(all)-n:]
+	}
+	return all
+}
+
+func (l *logRing) subscribe() (<-chan string, func()) {
+	c := make(chan string, 100)
+	l.Lock()
+	l.subs[c] = struct{}{}
+	l.Unlock()
+	return c, func() {
+		l.Lock()
+		delete(l.subs, c)
+		l.Unlock()
+	}
+}
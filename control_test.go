@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestLogRing(t *testing.T) {
+	l := newLogRing(3)
+	l.Write([]byte("a\nb\n"))
+	if got := strings.Join(l.tail(0), ""); got != "a\nb\n" {
+		t.Errorf("tail = %q", got)
+	}
+	l.Write([]byte("c\nd\n"))
+	if got := strings.Join(l.tail(0), ""); got != "b\nc\nd\n" {
+		t.Errorf("tail after wrapping = %q", got)
+	}
+	if got := strings.Join(l.tail(2), ""); got != "c\nd\n" {
+		t.Errorf("tail(2) = %q", got)
+	}
+}
+
+func TestControl(t *testing.T) {
+	base := testRepo(t)
+	setSHA(base)
+	cfg = new(command)
+	*socket = path.Join(t.TempDir(), "esc.sock")
+	s, _ := testSupervisor(t)
+
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serveControl(c)
+	go func() {
+		for {
+			select {
+			case req := <-control:
+				req.reply <- s.handle(req)
+			case <-c.Done():
+				return
+			}
+		}
+	}()
+
+	var resp *http.Response
+	for i := 0; i < 100; i++ {
+		var er error
+		if resp, er = controlClient().Get("http://escarole/status"); er == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if resp == nil {
+		t.Fatal("control socket not up")
+	}
+	defer resp.Body.Close()
+	var r struct {
+		OK   bool      `json:"ok"`
+		Data appStatus `json:"data"`
+	}
+	if er := json.NewDecoder(resp.Body).Decode(&r); er != nil {
+		t.Fatal(er)
+	}
+	if !r.OK || r.Data.SHA != base || r.Data.App != *name {
+		t.Errorf("status = %+v", r)
+	}
+
+	resp, er := controlClient().PostForm("http://escarole/bogus", nil)
+	if er != nil {
+		t.Fatal(er)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict || !strings.Contains(string(b), "unknown action") {
+		t.Errorf("unknown action answered %s: %s", resp.Status, b)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	base := testRepo(t)
+	setSHA(base)
+	cfg = new(command)
+	held, previous = new(hold), ""
+	s, log := testSupervisor(t)
+	head := commitFile(t, "a", "new")
+
+	if ok, er := s.finish(head, nil); !ok || er != nil {
+		t.Fatalf("finish: %v", er)
+	}
+	step(t, s)
+	if er := s.rollback(""); er != nil {
+		t.Fatal(er)
+	}
+	step(t, s)
+	if shas := startedOn(t, log, 3); shas[2] != base || sha != base {
+		t.Errorf("started on %v, at %s", shas, sha)
+	}
+	if er := s.rollback(base); er == nil {
+		t.Error("rolled back to the running sha")
+	}
+
+	// The skipped and previous sha survive an escarole restart.
+	held = new(hold)
+	if er := loadHold(); er != nil {
+		t.Fatal(er)
+	}
+	if held.Skipped != head {
+		t.Errorf("skipped %q after reload, want %s", held.Skipped, head)
+	}
+	if last := lastDeployment(); last.SHA != base || last.Old != head {
+		t.Errorf("last deployment %+v", last)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/albertrdixon/gearbox/logger"
+)
+
+const (
+	deploymentsFile = "deployments.jsonl"
+	changelogFile   = "CHANGELOG"
+
+	// deploymentsKeep is how many deployment records are kept.
+	deploymentsKeep = 500
+)
+
+// previous is the sha that was running before the last deployment.
+var previous string
+
+type deployment struct {
+	Time    time.Time `json:"time"`
+	Reason  string    `json:"reason"`
+	Old     string    `json:"old_sha,omitempty"`
+	SHA     string    `json:"sha"`
+	Ref     string    `json:"ref"`
+	Commits []commit  `json:"commits,omitempty"`
+}
+
+// stateDir holds escarole's bookkeeping for the app, outside of the clone.
+func stateDir() string {
+	return path.Join(home, ".escarole", *name)
+}
+
+// deploy logs and records moving the app from old to new and writes the
+// changelog the app can read through APP_CHANGELOG.
+func deploy(reason, old, new string) []commit {
+	commits, er := commitRange(old, new)
+	if er != nil {
+		logger.Warnf("Unable to list commits %s..%s: %v", short(old), short(new), er)
+	}
+	if old != "" && old != new {
+		logger.Infof("Deploying %s..%s (%d commits)", short(old), short(new), len(commits))
+		for _, c := range commits {
+			logger.Infof("  %s %s %s: %s", short(c.SHA), c.Date.Format("2006-01-02"), c.Author, c.Subject)
+		}
+	}
+
+	d := &deployment{
+		Time:    time.Now().UTC(),
+		Reason:  reason,
+		Old:     old,
+		SHA:     new,
+		Ref:     ref,
+		Commits: commits,
+	}
+	if er := d.save(); er != nil {
+		logger.Warnf("Unable to record deployment: %v", er)
+	}
+	if old != new {
+		previous = old
+	}
+	return commits
+}
+
+func (d *deployment) save() error {
+	dir := stateDir()
+	if er := os.MkdirAll(dir, 0755); er != nil {
+		return er
+	}
+
+	f, er := os.OpenFile(path.Join(dir, deploymentsFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if er != nil {
+		return er
+	}
+	er = json.NewEncoder(f).Encode(d)
+	f.Close()
+	if er != nil {
+		return er
+	}
+	if er := trimDeployments(deploymentsKeep); er != nil {
+		return er
+	}
+
+	cl, er := os.Create(path.Join(dir, changelogFile))
+	if er != nil {
+		return er
+	}
+	defer cl.Close()
+	w := bufio.NewWriter(cl)
+	fmt.Fprintf(w, "%s %s (%s) %s\n", d.Time.Format(time.RFC3339), d.Reason, d.Ref, d.SHA)
+	for _, c := range d.Commits {
+		fmt.Fprintf(w, "%s %s %s: %s\n", c.SHA, c.Date.Format(time.RFC3339), c.Author, c.Subject)
+	}
+	if er := w.Flush(); er != nil {
+		return er
+	}
+	return cl.Chown(int(*uid), int(*gid))
+}
+
+// trimDeployments drops all but the latest keep deployment records.
+func trimDeployments(keep int) error {
+	list, er := deployments()
+	if er != nil || len(list) <= keep {
+		return er
+	}
+
+	file := path.Join(stateDir(), deploymentsFile)
+	tmp := file + ".new"
+	f, er := os.Create(tmp)
+	if er != nil {
+		return er
+	}
+	enc := json.NewEncoder(f)
+	for _, d := range list[len(list)-keep:] {
+		if er := enc.Encode(d); er != nil {
+			f.Close()
+			return er
+		}
+	}
+	if er := f.Close(); er != nil {
+		return er
+	}
+	return os.Rename(tmp, file)
+}
+
+// lastDeployed returns the sha of the latest recorded deployment.
+func lastDeployed() string {
+	return lastDeployment().SHA
+}
+
+// lastDeployment returns the latest recorded deployment, a zero one if there
+// is none.
+func lastDeployment() deployment {
+	list, er := deployments()
+	if er != nil {
+		logger.Warnf("Unable to read deployments: %v", er)
+	}
+	if len(list) < 1 {
+		return deployment{}
+	}
+	return list[len(list)-1]
+}
+
+// deployments reads back the recorded deployments, oldest first.
+func deployments() ([]deployment, error) {
+	f, er := os.Open(path.Join(stateDir(), deploymentsFile))
+	if os.IsNotExist(er) {
+		return nil, nil
+	} else if er != nil {
+		return nil, er
+	}
+	defer f.Close()
+
+	var list []deployment
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for s.Scan() {
+		var d deployment
+		if er := json.Unmarshal(s.Bytes(), &d); er != nil {
+			continue
+		}
+		list = append(list, d)
+	}
+	return list, s.Err()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestTrimDeployments(t *testing.T) {
+	home, *name = t.TempDir(), "app"
+	*uid, *gid = uint32(os.Getuid()), uint32(os.Getgid())
+
+	for i := 0; i < 5; i++ {
+		d := &deployment{Reason: "update", SHA: fmt.Sprint("sha", i)}
+		if er := d.save(); er != nil {
+			t.Fatal(er)
+		}
+	}
+	if er := trimDeployments(3); er != nil {
+		t.Fatal(er)
+	}
+
+	list, er := deployments()
+	if er != nil {
+		t.Fatal(er)
+	}
+	if len(list) != 3 || list[0].SHA != "sha2" || list[2].SHA != "sha4" {
+		t.Errorf("got %+v", list)
+	}
+	if last := lastDeployed(); last != "sha4" {
+		t.Errorf("last deployed %q", last)
+	}
+	if er := trimDeployments(3); er != nil {
+		t.Fatal(er)
+	}
+	if list, _ := deployments(); len(list) != 3 {
+		t.Errorf("got %d records after trimming again", len(list))
+	}
+}
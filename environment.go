@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// secretSuffix marks vars whose value is a file to read the real value from,
+// e.g. FOO_FILE=/run/secrets/foo sets FOO.
+const secretSuffix = "_FILE"
+
+// secretsDir is where Docker and Kubernetes mount secrets. *_FILE vars
+// pointing below it are always resolved.
+const secretsDir = "/run/secrets/"
+
+// escaroleVars are escarole's own settings, kept out of the app env by default.
+var escaroleVars = []string{
+	"BRANCH", "CONFIG", "LOG_LEVEL", "LOG_FORMAT", "LOG_PASSTHROUGH", "LOG_TARGET", "SYSLOG_ADDR",
+	"UPDATE_INTERVAL", "APP_UID", "APP_GID", "ESCAROLE_SOCKET", "PIN",
+	"MIN_COMMIT_AGE", "APPROVAL", "APPROVAL_TTL",
+}
+
+type environment struct {
+	Inherit *bool             `json:"inherit"`
+	Allow   []string          `json:"allow"`
+	Deny    []string          `json:"deny"`
+	Files   []string          `json:"files"`
+	Vars    map[string]string `json:"vars"`
+	Secrets []string          `json:"secrets"`
+}
+
+// compose builds the app environment. Later sources win: inherited vars,
+// env files, config vars, --env flags, then escarole-provided APP_* vars.
+func (e *environment) compose() ([]string, error) {
+	if e == nil {
+		e = new(environment)
+	}
+	env := make(map[string]string)
+
+	if e.Inherit == nil || *e.Inherit {
+		deny := append(escaroleVars, e.Deny...)
+		for _, kv := range os.Environ() {
+			k, v := split(kv)
+			if len(e.Allow) > 0 && !matchAny(e.Allow, k) {
+				continue
+			}
+			if matchAny(deny, k) {
+				continue
+			}
+			env[k] = v
+		}
+	}
+
+	dir := path.Join(home, *name)
+	for _, f := range e.Files {
+		f = os.ExpandEnv(f)
+		if !path.IsAbs(f) {
+			f = path.Join(dir, f)
+		}
+		if er := readEnvFile(f, env); er != nil {
+			return nil, fmt.Errorf("env file %s: %v", f, er)
+		}
+	}
+	e.expandVars(env)
+	for k, v := range *appEnv {
+		env[k] = v
+	}
+
+	for k, v := range env {
+		if !strings.HasSuffix(k, secretSuffix) || k == secretSuffix {
+			continue
+		}
+		// Plenty of tools set *_FILE to a path they read themselves, only
+		// resolve the ones meant as secrets.
+		v = path.Clean(v)
+		if !matchAny(e.Secrets, k) && !strings.HasPrefix(v, secretsDir) {
+			continue
+		}
+		key := strings.TrimSuffix(k, secretSuffix)
+		if _, ok := env[key]; ok {
+			continue
+		}
+		b, er := readAsApp(v)
+		if er != nil {
+			return nil, fmt.Errorf("%s: %v", k, er)
+		}
+		env[key] = strings.TrimRight(string(b), "\r\n")
+		delete(env, k)
+	}
+
+	env["APP_NAME"] = *name
+	env["APP_HOME"] = dir
+	env["APP_SHA"] = sha
+	env["APP_REF"] = ref
+	env["APP_PREVIOUS_SHA"] = previous
+	env["APP_CHANGELOG"] = path.Join(stateDir(), changelogFile)
+	cfg.Build.env(env)
+
+	list := make([]string, 0, len(env))
+	for k, v := range env {
+		list = append(list, k+"="+v)
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// expandVars sets the config vars in env. Vars may refer to each other, so
+// each is expanded after the ones it uses; in a cycle, or a var referring to
+// itself, the reference gets the value from before the config vars.
+func (e *environment) expandVars(env map[string]string) {
+	keys := make([]string, 0, len(e.Vars))
+	for k := range e.Vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	done := make(map[string]bool, len(keys))
+	var set func(k string)
+	set = func(k string) {
+		if done[k] {
+			return
+		}
+		done[k] = true
+		v := os.Expand(e.Vars[k], func(ref string) string {
+			if _, ok := e.Vars[ref]; ok {
+				set(ref)
+			}
+			if v, ok := env[ref]; ok {
+				return v
+			}
+			return os.Getenv(ref)
+		})
+		env[k] = v
+	}
+	for _, k := range keys {
+		set(k)
+	}
+}
+
+// readAsApp reads file with the app user's permissions, so a secret only
+// escarole can read does not leak into the app env.
+func readAsApp(file string) ([]byte, error) {
+	cmd := exec.Command("cat", file)
+	cmd.Dir = "/"
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: *uid, Gid: *gid},
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	b, er := cmd.Output()
+	if er != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%v: %s", er, msg)
+		}
+		return nil, er
+	}
+	return b, nil
+}
+
+// readEnvFile parses a .env style file into env. Missing files are skipped.
+func readEnvFile(file string, env map[string]string) error {
+	f, er := os.Open(file)
+	if os.IsNotExist(er) {
+		return nil
+	} else if er != nil {
+		return er
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		if !strings.Contains(line, "=") {
+			return fmt.Errorf("line %d: expected KEY=VALUE", n)
+		}
+		k, v := split(line)
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+
+		switch {
+		case len(v) > 1 && v[0] == '\'' && v[len(v)-1] == '\'':
+			v = v[1 : len(v)-1]
+		case len(v) > 1 && v[0] == '"' && v[len(v)-1] == '"':
+			v = strings.NewReplacer(`\n`, "\n", `\"`, `"`, `\\`, `\`).Replace(v[1 : len(v)-1])
+			v = expand(v, env)
+		default:
+			if i := strings.Index(v, " #"); i >= 0 {
+				v = strings.TrimSpace(v[:i])
+			}
+			v = expand(v, env)
+		}
+		env[k] = v
+	}
+	return s.Err()
+}
+
+// envMap turns a KEY=VALUE list back into a map.
+func envMap(list []string) map[string]string {
+	m := make(map[string]string, len(list))
+	for _, kv := range list {
+		k, v := split(kv)
+		m[k] = v
+	}
+	return m
+}
+
+func expand(s string, env map[string]string) string {
+	return os.Expand(s, func(k string) string {
+		if v, ok := env[k]; ok {
+			return v
+		}
+		return os.Getenv(k)
+	})
+}
+
+func split(kv string) (string, string) {
+	i := strings.Index(kv, "=")
+	if i < 0 {
+		return kv, ""
+	}
+	return kv[:i], kv[i+1:]
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
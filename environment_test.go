@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadEnvFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name, body string
+		want       map[string]string
+		err        string
+	}{
+		{"plain", "A=1\n\n# comment\nexport B = two\n", map[string]string{"A": "1", "B": "two"}, ""},
+		{"quotes", `A='x $HOME'` + "\n" + `B="a\nb \"q\""` + "\n", map[string]string{"A": "x $HOME", "B": "a\nb \"q\""}, ""},
+		{"trailing comment", "A=1 # one\nB=x#y\n", map[string]string{"A": "1", "B": "x#y"}, ""},
+		{"expansion", "A=1\nB=${A}2\nC=\"$B-3\"\n", map[string]string{"A": "1", "B": "12", "C": "12-3"}, ""},
+		{"empty value", "A=\n", map[string]string{"A": ""}, ""},
+		{"no equals", "A=1\nB\n", nil, "line 2: expected KEY=VALUE"},
+	}
+	for _, tt := range tests {
+		f := path.Join(dir, tt.name)
+		if er := ioutil.WriteFile(f, []byte(tt.body), 0600); er != nil {
+			t.Fatal(er)
+		}
+		env := make(map[string]string)
+		er := readEnvFile(f, env)
+		switch {
+		case tt.err != "":
+			if er == nil || !strings.Contains(er.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, er, tt.err)
+			}
+		case er != nil:
+			t.Errorf("%s: %v", tt.name, er)
+		case !reflect.DeepEqual(env, tt.want):
+			t.Errorf("%s: got %v, want %v", tt.name, env, tt.want)
+		}
+	}
+
+	if er := readEnvFile(path.Join(dir, "missing"), map[string]string{}); er != nil {
+		t.Errorf("missing file: %v", er)
+	}
+}
+
+func TestComposeSecrets(t *testing.T) {
+	home, *name = t.TempDir(), "app"
+	*uid, *gid = uint32(os.Getuid()), uint32(os.Getgid())
+	secret := path.Join(home, "token")
+	if er := ioutil.WriteFile(secret, []byte("s3cret\n"), 0600); er != nil {
+		t.Fatal(er)
+	}
+
+	off := false
+	e := &environment{
+		Inherit: &off,
+		Vars: map[string]string{
+			"TOKEN_FILE":  secret,
+			"CERT_FILE":   secret,
+			"ESCAPE_FILE": secretsDir + "../.." + secret,
+			"SET_FILE":    secret,
+			"SET":         "kept",
+		},
+		Secrets: []string{"TOKEN_*", "SET_FILE"},
+	}
+	list, er := e.compose()
+	if er != nil {
+		t.Fatal(er)
+	}
+	env := envMap(list)
+
+	if _, ok := env["TOKEN_FILE"]; env["TOKEN"] != "s3cret" || ok {
+		t.Errorf("listed secret: got TOKEN=%q TOKEN_FILE=%q", env["TOKEN"], env["TOKEN_FILE"])
+	}
+	if _, ok := env["CERT"]; ok || env["CERT_FILE"] != secret {
+		t.Errorf("unlisted *_FILE was resolved: %v", env)
+	}
+	if _, ok := env["ESCAPE"]; ok {
+		t.Errorf("path escaping %s was resolved", secretsDir)
+	}
+	if env["SET"] != "kept" || env["SET_FILE"] != secret {
+		t.Errorf("secret overrode a set var: SET=%q SET_FILE=%q", env["SET"], env["SET_FILE"])
+	}
+
+	e = &environment{Inherit: &off, Vars: map[string]string{"MISSING_FILE": path.Join(home, "nope")}, Secrets: []string{"*"}}
+	if _, er := e.compose(); er == nil || !strings.Contains(er.Error(), "MISSING_FILE") {
+		t.Errorf("missing secret: got %v", er)
+	}
+}
+
+func TestExpandVars(t *testing.T) {
+	os.Setenv("ESCAROLE_TEST_BASE", "/base")
+	defer os.Unsetenv("ESCAROLE_TEST_BASE")
+
+	e := &environment{Vars: map[string]string{
+		"A":    "${B}/a",
+		"B":    "${C}/b",
+		"C":    "${ESCAROLE_TEST_BASE}/c",
+		"PATH": "/opt/bin:${PATH}",
+		"X":    "${Y}x",
+		"Y":    "${X}y",
+	}}
+	env := map[string]string{"PATH": "/bin", "X": "old"}
+	e.expandVars(env)
+
+	want := map[string]string{
+		"A":    "/base/c/b/a",
+		"B":    "/base/c/b",
+		"C":    "/base/c",
+		"PATH": "/opt/bin:/bin",
+		"X":    "oldyx",
+		"Y":    "oldy",
+	}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("got %v, want %v", env, want)
+	}
+}
@@ -15,106 +15,163 @@ import (
 	"github.com/albertrdixon/gearbox/logger"
 	"github.com/albertrdixon/gearbox/process"
 	"github.com/cenkalti/backoff"
-	"github.com/ghodss/yaml"
 	"golang.org/x/net/context"
 )
 
+type commit struct {
+	SHA     string    `json:"sha"`
+	Author  string    `json:"author"`
+	Date    time.Time `json:"date"`
+	Subject string    `json:"subject"`
+}
+
 type command struct {
-	Cmd string
+	settings
+	Project   string `json:"project"`
+	Name      string `json:"name"`
+	Cmd       string
+	Env       *environment     `json:"env"`
+	Templates []configTemplate `json:"templates"`
+	Logs      *appLogs         `json:"logs"`
+	Notify    []notifier       `json:"notifications"`
+	Limits    *limits          `json:"limits"`
+	Verify    *verification    `json:"verify"`
+	Clone     *cloneOptions    `json:"clone"`
+	Restart   *restartFilter   `json:"restart"`
+	Rules     []rule           `json:"rules"`
+	Build     *build           `json:"build"`
+	Preflight *preflight       `json:"preflight"`
+	Busy      *busyCheck       `json:"busy"`
+	Snapshots *snapshots       `json:"snapshots"`
+
+	ReloadSignal string       `json:"reload_signal"`
+	ReloadCheck  *reloadCheck `json:"reload_check"`
+}
+
+// rules returns the build steps followed by the configured rules.
+func (c *command) rules() []rule {
+	return append(c.Build.rules(), c.Rules...)
 }
 
-func read(file string) (cmd []string, er error) {
+var cfg = new(command)
+
+func read(file string) (c *command, er error) {
 	logger.Debugf("Reading command config %q", file)
 	body, er := ioutil.ReadFile(file)
 	if er != nil {
 		return
 	}
 
-	c := new(command)
-	if er = yaml.Unmarshal(body, c); er != nil {
-		return
+	c = new(command)
+	if er = decodeConfig(file, body, c); er != nil {
+		return nil, er
+	}
+	if er = c.validate(); er != nil {
+		return nil, er
 	}
 
 	logger.Debugf("Raw command: %s", c.Cmd)
-	cmd = strings.Fields(os.ExpandEnv(c.Cmd))
 	return
 }
 
-func prepareApp(ctx context.Context) (app *process.Process, er error) {
+func prepareApp(ctx context.Context) (app *appProcess, er error) {
 	var (
+		c   *command
 		cmd []string
 	)
 
-	if cmd, er = read(*conf); er != nil {
+	if c, er = read(*conf); er != nil {
+		return
+	}
+	cfg = c
+
+	e, er := c.Env.compose()
+	if er != nil {
+		return
+	}
+	if cmd = strings.Fields(expand(c.Cmd, envMap(e))); len(cmd) < 1 {
+		er = errors.New("no command configured")
 		return
 	}
 
 	logger.Debugf("Looking for %q in PATH", cmd[0])
-	if cmd[0], er = exec.LookPath(cmd[0]); er != nil {
+	if cmd[0], er = lookPath(cmd[0], envMap(e)); er != nil {
+		return
+	}
+	if cmd, er = c.Limits.wrap(cmd); er != nil {
 		return
 	}
 
-	if app, er = process.New(*name, strings.Join(cmd, " "), stdout...); er != nil {
+	out, errOut := consoleWriters(func() int { return app.Pid() })
+	if app, er = newAppProcess(*name, cmd, out...); er != nil {
 		return
 	}
+	app.AddWriter(recent).AddErrWriter(recent)
+	for _, w := range errOut {
+		app.AddErrWriter(w)
+	}
 
-	if len(*env) > 0 {
-		e := make([]string, 0, len(*env))
-		for k, v := range *env {
-			e = append(e, k+"="+v)
+	if c.Logs != nil {
+		if er = addLogSinks(app, c.Logs); er != nil {
+			return
 		}
-		app.SetEnv(e)
 	}
 
 	app.SetDir(path.Join(home, *name))
-	app.SetUser(*uid, *gid)
+	// The shim needs escarole's privileges to raise hard limits, it switches
+	// to the app user itself.
+	if !c.Limits.sandboxed() {
+		app.SetUser(*uid, *gid)
+	}
+	if c.Limits != nil && c.Limits.Cgroup != nil {
+		er = setupCgroup(app, *name, c.Limits.Cgroup)
+	}
 	return
 }
 
-func run(app *process.Process, c context.Context, cancel context.CancelFunc) {
-	var (
-		failures = 0
-		up       = time.NewTicker(*interval)
-	)
-
-	if er := app.Execute(c); er != nil {
-		logger.Errorf("%v failed to execute: %v", app, er)
-		return
+// execute (re)starts the app with a freshly composed environment and
+// rendered templates.
+func execute(app *appProcess, c context.Context) error {
+	e, er := cfg.Env.compose()
+	if er != nil {
+		return er
 	}
+	if _, er := renderTemplates(cfg.Templates, e); er != nil {
+		return er
+	}
+	return app.SetEnv(e).Execute(c)
+}
 
-	for failures < 10 {
-		select {
-		case <-c.Done():
-			return
-		case <-app.Exited():
-			if er := app.Execute(c); er != nil {
-				logger.Errorf("%v failed to execute: %v", app, er)
-				failures++
-				time.Sleep(2 * time.Minute)
-			}
-		case t := <-up.C:
-			logger.Infof("Updating %v at %v", *name, t.Format(time.Stamp))
-			head, updated, er := update(c)
-			if er != nil {
-				logger.Errorf("Failed update: %v", er)
-				continue
-			}
-			if updated {
-				logger.Infof("Restarting %v", app)
-				if er := stop(app, c); er != nil {
-					logger.Errorf("Failed to kill %v: %v", app, er)
-					failures++
-				} else {
-					sha = head
-				}
-			}
+// reloadApp re-reads the config and returns a new app if the command or any
+// rendered template changed, nil otherwise.
+func reloadApp(c context.Context) (next *appProcess, er error) {
+	// prepareApp swaps in the new config, which only sticks once the app env
+	// and templates worked out with it.
+	old := cfg
+	defer func() {
+		if er != nil {
+			cfg = old
 		}
+	}()
+	if next, er = prepareApp(c); er != nil {
+		return nil, er
 	}
 
-	cancel()
+	e, er := cfg.Env.compose()
+	if er != nil {
+		return nil, er
+	}
+	changed, er := renderTemplates(cfg.Templates, e)
+	if er != nil {
+		return nil, er
+	}
+	if !changed && cfg.Cmd == old.Cmd {
+		return nil, nil
+	}
+	return next, nil
 }
 
-func stop(app *process.Process, c context.Context) error {
+func stop(app *appProcess, c context.Context) error {
 	exp := backoff.NewExponentialBackOff()
 	exp.MaxElapsedTime = 60 * time.Second
 
@@ -124,7 +181,7 @@ func stop(app *process.Process, c context.Context) error {
 	return backoff.RetryNotify(term(app, c), exp, notify)
 }
 
-func kill(app *process.Process, c context.Context) error {
+func kill(app *appProcess, c context.Context) error {
 	t := time.NewTimer(5 * time.Second)
 	defer t.Stop()
 
@@ -142,7 +199,7 @@ func kill(app *process.Process, c context.Context) error {
 	}
 }
 
-func term(app *process.Process, c context.Context) backoff.Operation {
+func term(app *appProcess, c context.Context) backoff.Operation {
 	return func() error {
 		t := time.NewTimer(5 * time.Second)
 		defer t.Stop()
@@ -162,7 +219,9 @@ func term(app *process.Process, c context.Context) backoff.Operation {
 	}
 }
 
-func update(c context.Context) (string, bool, error) {
+// update fetches upstream and moves the checkout to it. checked is a sha
+// that already passed verification and preflight, like a deferred one.
+func update(c context.Context, checked string) (string, bool, error) {
 	var (
 		dir    = path.Join(home, *name)
 		remote = []string{"remote", "update", "-p"}
@@ -173,7 +232,6 @@ func update(c context.Context) (string, bool, error) {
 			"recursive",
 			"-Xpatience",
 			"-Xrenormalize",
-			"@{u}",
 		}
 	)
 	// git remote update -p
@@ -191,6 +249,44 @@ func update(c context.Context) (string, bool, error) {
 	}
 	<-rem.Exited()
 
+	up, er := gitOutput("rev-parse", "@{u}")
+	if er != nil {
+		return sha, false, er
+	}
+	if held.Skipped != "" {
+		if up == held.Skipped {
+			logger.Infof("Upstream is still at %s which was rolled back, not updating", short(up))
+			return sha, false, nil
+		}
+		held.Skipped = ""
+		saveHold()
+	}
+	target, er := soaked(up)
+	if er != nil {
+		return sha, false, er
+	}
+	if target = approvedTarget(target, up); target == sha && up != sha {
+		return sha, false, nil
+	}
+	if rejected != "" {
+		if target == rejected {
+			logger.Infof("Upstream is still at %s which failed preflight, not updating", short(target))
+			return sha, false, nil
+		}
+		rejected = ""
+	}
+	if target != sha && target != checked {
+		if er := cfg.Verify.verify(target); er != nil {
+			return sha, false, er
+		}
+		if er := cfg.Preflight.test(c, target); er != nil {
+			if _, ok := er.(*unverified); ok {
+				rejected = target
+			}
+			return sha, false, er
+		}
+	}
+
 	// git checkout branch
 	co, er := process.New(
 		fmt.Sprintf("git-checkout-%s", ref),
@@ -206,32 +302,56 @@ func update(c context.Context) (string, bool, error) {
 	}
 	<-co.Exited()
 
-	// git merge
-	me, er := process.New(
-		"git-merge",
-		strings.Join(append([]string{git}, merge...), " "),
-		stdout...,
-	)
-	if er != nil {
-		return sha, false, er
+	var modules string
+	if cfg.Clone.submodules() {
+		modules = submoduleState()
 	}
 
-	if er := me.SetDir(dir).SetUser(*uid, *gid).Execute(c); er != nil {
-		return sha, false, er
+	if cfg.Clone.shallow() {
+		if er := fastForward(target); er != nil {
+			return sha, false, er
+		}
+	} else {
+		// git merge
+		me, er := process.New(
+			"git-merge",
+			strings.Join(append(append([]string{git}, merge...), target), " "),
+			stdout...,
+		)
+		if er != nil {
+			return sha, false, er
+		}
+
+		if er := me.SetDir(dir).SetUser(*uid, *gid).Execute(c); er != nil {
+			return sha, false, er
+		}
+		<-me.Exited()
+	}
+
+	// A submodule can change without HEAD moving, when it was out of date
+	// or its url changed.
+	changed := false
+	if cfg.Clone.submodules() {
+		if er := cfg.Clone.updateSubmodules(); er != nil {
+			return sha, false, er
+		}
+		if changed = submoduleState() != modules; changed {
+			logger.Infof("Submodules changed")
+		}
 	}
-	<-me.Exited()
 
 	// find sha
 	head, er := getSHA()
 	if er != nil {
 		return sha, false, er
 	}
-	return head, sha != head, nil
+	settleApproval(head)
+	return head, sha != head || changed, nil
 }
 
 func clone(c context.Context) error {
 	var (
-		args = []string{"clone", "--recursive", "--single-branch", "--progress"}
+		args = append([]string{"clone"}, cfg.Clone.args()...)
 	)
 	logger.Infof("Cloning %q", *project)
 
@@ -242,10 +362,7 @@ func clone(c context.Context) error {
 		return er
 	}
 
-	loc := fmt.Sprintf("git://github.com/%s.git", *project)
-	if *name == "" {
-		*name = strings.ToLower(path.Base(*project))
-	}
+	loc := remoteURL()
 	dir := path.Join(home, *name)
 	if er := os.Setenv("APP_HOME", dir); er != nil {
 		logger.Warnf("Unable to set APP_HOME env var: %v", er)
@@ -273,50 +390,104 @@ func clone(c context.Context) error {
 	return os.Chdir(dir)
 }
 
+func remoteURL() string {
+	return fmt.Sprintf("git://github.com/%s.git", *project)
+}
+
 func getSHA() (string, error) {
 	logger.Debugf("Determining HEAD sha")
-	b := new(bytes.Buffer)
-
-	sh := exec.Command(git, "rev-parse", "HEAD")
-	sh.Dir = path.Join(home, *name)
-	sh.SysProcAttr = &syscall.SysProcAttr{
-		Credential: &syscall.Credential{
-			Uid: *uid,
-			Gid: *gid,
-		},
-	}
-	sh.Stdout = b
-
-	if er := sh.Run(); er != nil {
+	h, er := gitOutput("rev-parse", "HEAD")
+	if er != nil {
 		return "", er
 	}
 
 	if sha != "" {
-		logger.Infof("HEAD sha: %s (current: %s)", b.String()[:10], sha[:10])
+		logger.Infof("HEAD sha: %s (current: %s)", short(h), short(sha))
 	} else {
-		logger.Infof("HEAD sha: %s", b.String()[:10])
+		logger.Infof("HEAD sha: %s", short(h))
 	}
-	return strings.TrimSpace(b.String()), nil
+	return h, nil
 }
 
 func getRef() (string, error) {
 	logger.Debugf("Determining current ref")
-	b := new(bytes.Buffer)
+	r, er := gitOutput("rev-parse", "--abbrev-ref", "HEAD")
+	if er != nil {
+		return "", er
+	}
+	logger.Infof("Current ref: %q", r)
+	return r, nil
+}
+
+// commitRange lists the commits in old..new, newest first.
+func commitRange(old, new string) ([]commit, error) {
+	if old == "" || new == "" || old == new {
+		return nil, nil
+	}
+	out, er := gitOutput("log", "--format=%H%x1f%an%x1f%cI%x1f%s", old+".."+new)
+	if er != nil {
+		return nil, er
+	}
+
+	var list []commit
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Split(line, "\x1f")
+		if len(f) < 4 {
+			continue
+		}
+		d, _ := time.Parse(time.RFC3339, f[2])
+		list = append(list, commit{SHA: f[0], Author: f[1], Date: d, Subject: f[3]})
+	}
+	return list, nil
+}
+
+// gitOutput runs git in the app dir as the app user and returns its trimmed
+// stdout.
+func gitOutput(args ...string) (string, error) {
+	return gitOutputEnv(nil, args...)
+}
 
-	re := exec.Command(git, "rev-parse", "--abbrev-ref", "HEAD")
-	re.Dir = path.Join(home, *name)
-	re.SysProcAttr = &syscall.SysProcAttr{
+// gitOutputEnv runs git with env added to escarole's environment.
+func gitOutputEnv(env []string, args ...string) (string, error) {
+	b, e := new(bytes.Buffer), new(bytes.Buffer)
+
+	cmd := exec.Command(git, args...)
+	cmd.Dir = path.Join(home, *name)
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Credential: &syscall.Credential{
 			Uid: *uid,
 			Gid: *gid,
 		},
 	}
-	re.Stdout = b
+	cmd.Stdout = b
+	cmd.Stderr = e
 
-	if er := re.Run(); er != nil {
+	if er := cmd.Run(); er != nil {
+		if msg := strings.TrimSpace(e.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %v: %s", args[0], er, msg)
+		}
 		return "", er
 	}
-	r := strings.TrimSpace(b.String())
-	logger.Infof("Current ref: %q", r)
-	return r, nil
+	return strings.TrimSpace(b.String()), nil
+}
+
+// splitNUL splits the output of a git command run with -z.
+func splitNUL(out string) []string {
+	list := []string{}
+	for _, f := range strings.Split(out, "\x00") {
+		if f != "" {
+			list = append(list, f)
+		}
+	}
+	return list
+}
+
+func short(s string) string {
+	if len(s) > 10 {
+		return s[:10]
+	}
+	return s
 }
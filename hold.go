@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/albertrdixon/gearbox/logger"
+)
+
+const holdFile = "state.json"
+
+// hold is what keeps updates back: the sha rolled back from and the pin,
+// pause and approval state set through the control socket. It is kept in the
+// state dir so it survives escarole restarts.
+type hold struct {
+	Skipped  string    `json:"skipped,omitempty"`
+	Pin      string    `json:"pin,omitempty"`
+	Paused   bool      `json:"paused,omitempty"`
+	Pending  *pending  `json:"pending,omitempty"`
+	Approved *approval `json:"approved,omitempty"`
+}
+
+var held = new(hold)
+
+func loadHold() error {
+	b, er := ioutil.ReadFile(path.Join(stateDir(), holdFile))
+	if os.IsNotExist(er) {
+		return nil
+	} else if er != nil {
+		return er
+	}
+	return json.Unmarshal(b, held)
+}
+
+func (h *hold) save() error {
+	dir := stateDir()
+	if er := os.MkdirAll(dir, 0755); er != nil {
+		return er
+	}
+	b, er := json.Marshal(h)
+	if er != nil {
+		return er
+	}
+	return ioutil.WriteFile(path.Join(dir, holdFile), b, 0644)
+}
+
+func saveHold() {
+	if er := held.save(); er != nil {
+		logger.Warnf("Unable to save %s: %v", holdFile, er)
+	}
+}
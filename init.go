@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const starterConfig = `# escarole config, see https://github.com/albertrdixon/escarole
+cmd: %s
+
+# project: Organization/Project
+# branch: master
+# update_interval: 24h
+# uid: 0
+# gid: 0
+# log_level: info
+
+# env:
+#   inherit: true
+#   files: [.env]
+#   vars:
+#     SOME_VAR: value
+
+# templates:
+#   - src: config.ini.tmpl
+#     dest: /data/config.ini
+#     mode: "0600"
+
+# logs:
+#   stdout:
+#     path: /data/logs/app.log
+#     max_size: 10MB
+#     max_files: 5
+#     compress: true
+
+# notifications:
+#   - type: slack
+#     url: https://hooks.slack.com/services/...
+
+# limits:
+#   rlimits:
+#     nofile: 4096
+#   no_new_privs: true
+`
+
+// initConfig writes a starter config to --config and returns the exit code.
+func initConfig(cmd string, force bool) int {
+	if _, er := os.Stat(*conf); er == nil && !force {
+		fmt.Fprintf(os.Stderr, "%s already exists, use --force to overwrite it\n", *conf)
+		return 1
+	}
+	if er := ioutil.WriteFile(*conf, []byte(fmt.Sprintf(starterConfig, quoteYAML(cmd))), 0644); er != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write %s: %v\n", *conf, er)
+		return 1
+	}
+	fmt.Printf("Wrote %s\n", *conf)
+	return 0
+}
+
+func quoteYAML(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
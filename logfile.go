@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/albertrdixon/gearbox/logger"
+)
+
+// rotateStamp names rotated files. Parsing with it also takes the
+// milliseconds rotatedStamp adds, and the bare seconds of older files.
+const (
+	rotateStamp  = "20060102-150405"
+	rotatedStamp = rotateStamp + ".000"
+)
+
+type appLogs struct {
+	Stdout *logSink `json:"stdout"`
+	Stderr *logSink `json:"stderr"`
+}
+
+type logSink struct {
+	Path     string   `json:"path"`
+	MaxSize  byteSize `json:"max_size"`
+	MaxAge   duration `json:"max_age"`
+	MaxFiles int      `json:"max_files"`
+	Compress bool     `json:"compress"`
+	Prefix   *bool    `json:"prefix"`
+}
+
+// rotatingFile is an io.Writer appending to a file that is rotated once it
+// grows past maxSize or gets older than maxAge.
+type rotatingFile struct {
+	sync.Mutex
+	*logSink
+	strip  []byte
+	f      *os.File
+	size   int64
+	opened time.Time
+	tidy   chan struct{}
+}
+
+var logFiles = map[string]*rotatingFile{}
+
+// addLogSinks tees app stdout and stderr to their log files.
+func addLogSinks(app *appProcess, l *appLogs) error {
+	o, er := l.Stdout.writer(*name)
+	if er != nil {
+		return er
+	}
+	if o != nil {
+		app.AddWriter(o)
+	}
+	e, er := l.Stderr.writer(*name)
+	if er != nil {
+		return er
+	}
+	if e != nil {
+		app.AddErrWriter(e)
+	}
+	return nil
+}
+
+// writer returns the sink for this app, reusing an already open one so a
+// config reload does not open the same file twice.
+func (s *logSink) writer(app string) (io.Writer, error) {
+	if s == nil || s.Path == "" {
+		return nil, nil
+	}
+	s.Path = os.ExpandEnv(s.Path)
+	if r, ok := logFiles[s.Path]; ok {
+		r.Lock()
+		r.logSink = s
+		r.Unlock()
+		return r, nil
+	}
+
+	r := &rotatingFile{logSink: s, strip: []byte(fmt.Sprintf("[%s] ", app)), tidy: make(chan struct{}, 1)}
+	if er := r.open(); er != nil {
+		return nil, er
+	}
+	logFiles[s.Path] = r
+	go r.tidyUp()
+	return r, nil
+}
+
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	n := len(b)
+	if r.Prefix != nil && !*r.Prefix {
+		b = bytes.TrimPrefix(b, r.strip)
+	}
+	if r.due(int64(len(b))) {
+		if er := r.rotate(); er != nil {
+			logger.Errorf("Failed to rotate %s: %v", r.Path, er)
+		}
+	}
+
+	w, er := r.f.Write(b)
+	r.size += int64(w)
+	if er != nil {
+		return w, er
+	}
+	return n, nil
+}
+
+func (r *rotatingFile) due(next int64) bool {
+	if r.MaxSize > 0 && r.size > 0 && r.size+next > int64(r.MaxSize) {
+		return true
+	}
+	return r.MaxAge > 0 && time.Since(r.opened) > time.Duration(r.MaxAge)
+}
+
+func (r *rotatingFile) open() error {
+	if er := os.MkdirAll(path.Dir(r.Path), 0755); er != nil {
+		return er
+	}
+	f, er := os.OpenFile(r.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if er != nil {
+		return er
+	}
+	fi, er := f.Stat()
+	if er != nil {
+		f.Close()
+		return er
+	}
+	r.f, r.size, r.opened = f, fi.Size(), fi.ModTime()
+	if r.size == 0 {
+		r.opened = time.Now()
+	}
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	if er := r.f.Close(); er != nil {
+		return er
+	}
+	// Two rotations within a millisecond must not overwrite each other.
+	now := time.Now()
+	old := r.Path + "." + now.Format(rotatedStamp)
+	for exists(old) || exists(old+".gz") {
+		now = now.Add(time.Millisecond)
+		old = r.Path + "." + now.Format(rotatedStamp)
+	}
+	if er := os.Rename(r.Path, old); er != nil {
+		return er
+	}
+	if er := r.open(); er != nil {
+		return er
+	}
+
+	select {
+	case r.tidy <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// tidyUp compresses and prunes rotated files after each rotation, one
+// rotation at a time. Rotations while it is busy are handled in one go.
+func (r *rotatingFile) tidyUp() {
+	for range r.tidy {
+		r.Lock()
+		s := *r.logSink
+		r.Unlock()
+
+		if s.Compress {
+			for _, f := range rotated(s.Path) {
+				if strings.HasSuffix(f, ".gz") {
+					continue
+				}
+				if er := compress(f); er != nil {
+					logger.Warnf("Failed to compress %s: %v", f, er)
+				}
+			}
+		}
+		prune(s.Path, s.MaxFiles)
+	}
+}
+
+func compress(file string) error {
+	in, er := os.Open(file)
+	if er != nil {
+		return er
+	}
+	defer in.Close()
+
+	out, er := os.OpenFile(file+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if er != nil {
+		return er
+	}
+	z := gzip.NewWriter(out)
+	if _, er := io.Copy(z, in); er != nil {
+		out.Close()
+		return er
+	}
+	if er := z.Close(); er != nil {
+		out.Close()
+		return er
+	}
+	if er := out.Close(); er != nil {
+		return er
+	}
+	return os.Remove(file)
+}
+
+// prune removes all but the newest keep rotated files of base.
+func prune(base string, keep int) {
+	if keep < 1 {
+		return
+	}
+	old := rotated(base)
+	if len(old) <= keep {
+		return
+	}
+	for _, f := range old[:len(old)-keep] {
+		logger.Debugf("Removing old log %s", f)
+		os.Remove(f)
+	}
+}
+
+// rotated lists the rotated files of base, oldest first.
+func rotated(base string) []string {
+	old, er := filepath.Glob(base + ".*")
+	if er != nil {
+		return nil
+	}
+	list := old[:0]
+	for _, f := range old {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(f, base+"."), ".gz")
+		if _, er := time.Parse(rotateStamp, stamp); er == nil {
+			list = append(list, f)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	base := path.Join(dir, "app.log")
+	no := false
+	s := &logSink{Path: base, MaxSize: 10, Prefix: &no}
+	w, er := s.writer("app")
+	if er != nil {
+		t.Fatal(er)
+	}
+
+	// Every line overflows the file, so these rotate within the same second.
+	for _, l := range []string{"one\n", "two\n", "three\n", "four\n"} {
+		if _, er := w.Write([]byte("[app] 0123456789 " + l)); er != nil {
+			t.Fatal(er)
+		}
+	}
+	old := rotated(base)
+	if len(old) != 3 {
+		t.Fatalf("got rotated files %v", old)
+	}
+	var all string
+	for _, f := range append(old, base) {
+		b, _ := ioutil.ReadFile(f)
+		all += string(b)
+	}
+	if all != "0123456789 one\n0123456789 two\n0123456789 three\n0123456789 four\n" {
+		t.Errorf("got %q", all)
+	}
+}
+
+func TestRotatingFileTidy(t *testing.T) {
+	dir := t.TempDir()
+	base := path.Join(dir, "app.log")
+
+	// Files from before the millisecond stamps are pruned as well.
+	if er := ioutil.WriteFile(base+".20200101-000000.gz", nil, 0644); er != nil {
+		t.Fatal(er)
+	}
+	s := &logSink{Path: base, MaxSize: 10, MaxFiles: 2, Compress: true}
+	w, er := s.writer("app")
+	if er != nil {
+		t.Fatal(er)
+	}
+	for i := 0; i < 5; i++ {
+		w.Write([]byte("[app] a line that rotates\n"))
+	}
+
+	var files []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		files, _ = filepath.Glob(base + ".*")
+		if len(files) == 2 && strings.HasSuffix(files[0], ".gz") && strings.HasSuffix(files[1], ".gz") {
+			break
+		}
+	}
+	if len(files) != 2 {
+		t.Fatalf("got %v", files)
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f, ".gz") || strings.Contains(f, "20200101") {
+			t.Errorf("got %v", files)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/albertrdixon/gearbox/logger"
+)
+
+const logPrefix = "[escarole] "
+
+var (
+	// structured is set unless logging plain text to the console.
+	structured *structLog
+
+	levelOrder = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3, "fatal": 4}
+)
+
+type record map[string]interface{}
+
+// recordWriter is a log target: the console, syslog or journald.
+type recordWriter interface {
+	writeRecord(rec record) error
+}
+
+// structLog turns escarole log lines and app output lines into records.
+type structLog struct {
+	sync.Mutex
+	out         recordWriter
+	passthrough bool
+
+	// sha is the deployed sha records carry. Set under the lock, the app
+	// output goroutines emit while the supervisor moves it.
+	sha string
+}
+
+// logStream is the writer handed to processes for one of their streams.
+type logStream struct {
+	*structLog
+	stream string
+	pid    func() int
+}
+
+// jsonConsole writes records as JSON lines.
+type jsonConsole struct {
+	w io.Writer
+}
+
+func configureLogging() {
+	var out recordWriter
+	switch *logTarget {
+	case "syslog":
+		s, er := dialSyslog(*syslogAddr)
+		if er != nil {
+			logger.Configure(*logLevel, logPrefix, os.Stdout)
+			logger.Fatalf("Unable to connect to syslog: %v", er)
+		}
+		out = s
+	case "journald":
+		j, er := dialJournal()
+		if er != nil {
+			logger.Configure(*logLevel, logPrefix, os.Stdout)
+			logger.Fatalf("Unable to connect to journald: %v", er)
+		}
+		out = j
+	default:
+		if *logFormat != "json" {
+			logger.Configure(*logLevel, logPrefix, os.Stdout)
+			return
+		}
+		out = &jsonConsole{w: os.Stdout}
+	}
+
+	structured = &structLog{out: out, passthrough: *logPassthrough}
+	logger.Configure(*logLevel, logPrefix, structured)
+	log.SetFlags(0)
+	stdout = []io.Writer{structured.stream("stdout", nil)}
+}
+
+// consoleWriters returns the console writers for the app's stdout and stderr.
+func consoleWriters(pid func() int) (out, errOut []io.Writer) {
+	if structured == nil {
+		return stdout, stdout
+	}
+	return []io.Writer{structured.stream("stdout", pid)}, []io.Writer{structured.stream("stderr", pid)}
+}
+
+// logEvent logs a lifecycle event. Text output is unchanged, structured
+// output carries the event name.
+func logEvent(lvl, event, f string, m ...interface{}) {
+	if structured == nil {
+		switch lvl {
+		case "debug":
+			logger.Debugf(f, m...)
+		case "warn":
+			logger.Warnf(f, m...)
+		case "error":
+			logger.Errorf(f, m...)
+		default:
+			logger.Infof(f, m...)
+		}
+		return
+	}
+	if levelOrder[lvl] < levelOrder[string(logger.Level())] {
+		return
+	}
+	structured.emit(record{
+		"level": lvl,
+		"event": event,
+		"msg":   fmt.Sprintf(f, m...),
+	})
+}
+
+func (l *structLog) stream(name string, pid func() int) *logStream {
+	return &logStream{structLog: l, stream: name, pid: pid}
+}
+
+// Write takes lines from the gearbox logger, "[escarole] [level] message".
+func (l *structLog) Write(b []byte) (int, error) {
+	line := strings.TrimPrefix(strings.TrimRight(string(b), "\n"), logPrefix)
+	rec := record{"level": "info", "msg": line}
+	if strings.HasPrefix(line, "[") {
+		if i := strings.Index(line, "] "); i > 0 {
+			rec["level"], rec["msg"] = line[1:i], line[i+2:]
+		}
+	}
+	if er := l.emit(rec); er != nil {
+		return 0, er
+	}
+	return len(b), nil
+}
+
+// Write takes lines from appProcess.stream, "[name] output".
+func (s *logStream) Write(b []byte) (int, error) {
+	line := strings.TrimRight(string(b), "\n")
+	app := ""
+	if strings.HasPrefix(line, "[") {
+		if i := strings.Index(line, "] "); i > 0 {
+			app, line = line[1:i], line[i+2:]
+		}
+	}
+
+	rec := record{}
+	if !s.passthrough || !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &rec) != nil {
+		rec = record{"msg": line}
+	}
+	for k, v := range (record{"app": app, "stream": s.stream}) {
+		if _, ok := rec[k]; !ok {
+			rec[k] = v
+		}
+	}
+	if _, ok := rec["pid"]; !ok && s.pid != nil {
+		rec["pid"] = s.pid()
+	}
+	if er := s.emit(rec); er != nil {
+		return 0, er
+	}
+	return len(b), nil
+}
+
+func (l *structLog) emit(rec record) error {
+	if _, ok := rec["time"]; !ok {
+		rec["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	if _, ok := rec["app"]; !ok {
+		rec["app"] = *name
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := rec["sha"]; !ok && l.sha != "" {
+		rec["sha"] = l.sha
+	}
+	return l.out.writeRecord(rec)
+}
+
+// setSHA moves sha, the deployed commit, along with the one log records
+// carry.
+func setSHA(s string) {
+	sha = s
+	if structured != nil {
+		structured.Lock()
+		structured.sha = s
+		structured.Unlock()
+	}
+}
+
+func (j *jsonConsole) writeRecord(rec record) error {
+	b := new(bytes.Buffer)
+	if er := json.NewEncoder(b).Encode(rec); er != nil {
+		return er
+	}
+	_, er := j.w.Write(b.Bytes())
+	return er
+}
+
+// message renders the record body for syslog and journald, either the plain
+// message or the whole record as JSON.
+func (r record) message() string {
+	if *logFormat == "json" {
+		b, _ := json.Marshal(r)
+		return string(b)
+	}
+	return r.str("msg")
+}
+
+func (r record) str(k string) string {
+	if v, ok := r[k]; ok && v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// fromApp tells app output apart from escarole's own lines.
+func (r record) fromApp() bool {
+	_, ok := r["stream"]
+	return ok
+}
+
+// severity maps the record to a syslog severity. App lines without a level
+// of their own are info on stdout and warning on stderr.
+func (r record) severity() int {
+	switch r.str("level") {
+	case "debug":
+		return 7
+	case "info":
+		return 6
+	case "warn", "warning":
+		return 4
+	case "error":
+		return 3
+	case "fatal":
+		return 2
+	}
+	if r.str("stream") == "stderr" {
+		return 4
+	}
+	return 6
+}
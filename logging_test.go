@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// records collects what a structLog writes.
+type records struct {
+	sync.Mutex
+	list []record
+}
+
+func (r *records) writeRecord(rec record) error {
+	r.Lock()
+	defer r.Unlock()
+	r.list = append(r.list, rec)
+	return nil
+}
+
+func TestStructLog(t *testing.T) {
+	*name = "app"
+	out := new(records)
+	l := &structLog{out: out, passthrough: true}
+	structured = l
+	defer func() { structured = nil; setSHA("") }()
+	setSHA("abc")
+
+	l.Write([]byte(logPrefix + "[warn] disk full\n"))
+	l.stream("stdout", func() int { return 42 }).Write([]byte(`[app] {"level": "error", "msg": "boom", "sha": "mine"}` + "\n"))
+	l.stream("stderr", nil).Write([]byte("[app] plain {\n"))
+
+	want := []record{
+		{"level": "warn", "msg": "disk full", "app": "app", "sha": "abc"},
+		{"level": "error", "msg": "boom", "app": "app", "sha": "mine", "stream": "stdout", "pid": 42},
+		{"msg": "plain {", "app": "app", "sha": "abc", "stream": "stderr"},
+	}
+	if len(out.list) != len(want) {
+		t.Fatalf("got %d records", len(out.list))
+	}
+	for i, w := range want {
+		got := out.list[i]
+		if got["time"] == nil {
+			t.Errorf("record %d has no time", i)
+		}
+		delete(got, "time")
+		if len(got) != len(w) {
+			t.Errorf("record %d: got %v, want %v", i, got, w)
+			continue
+		}
+		for k, v := range w {
+			if got[k] != v {
+				t.Errorf("record %d: %s is %v, want %v", i, k, got[k], v)
+			}
+		}
+	}
+}
+
+// App output is logged while the supervisor moves sha, run with -race.
+func TestStructLogSHA(t *testing.T) {
+	out := new(records)
+	structured = &structLog{out: out}
+	defer func() { structured = nil; setSHA("") }()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w := structured.stream("stdout", nil)
+		for i := 0; i < 100; i++ {
+			w.Write([]byte("[app] line\n"))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		setSHA("abc")
+	}
+	wg.Wait()
+	for _, r := range out.list {
+		if r["sha"] != nil && r["sha"] != "abc" {
+			t.Errorf("got sha %v", r["sha"])
+		}
+	}
+}
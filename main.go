@@ -1,11 +1,15 @@
 package main
 
 import (
+	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
@@ -17,37 +21,137 @@ import (
 
 var (
 	app      = kingpin.New("escarole", "Keeps your app leafy fresh!")
-	project  = app.Arg("project", "github project. Format: Organization/Project, e.g. albertrdixon/escarole").Required().String()
-	name     = app.Arg("name", "app name. If not given will use lowercase project name, e.g. Org/MyProject -> myproject").String()
-	conf     = app.Flag("config", "path to command config").Short('C').Default("/escarole.yml").OverrideDefaultFromEnvar("CONFIG").ExistingFile()
+	conf     = app.Flag("config", "path to command config").Short('C').Default("/escarole.yml").OverrideDefaultFromEnvar("CONFIG").String()
 	branch   = app.Flag("branch", "branch to use").Short('b').OverrideDefaultFromEnvar("BRANCH").String()
 	interval = app.Flag("update-interval", "app update interval. Must be able to be parsed by time.ParseDuration").Short('u').Default("24h").OverrideDefaultFromEnvar("UPDATE_INTERVAL").Duration()
 	uid      = app.Flag("uid", "app uid").Default("0").OverrideDefaultFromEnvar("APP_UID").Uint32()
 	gid      = app.Flag("gid", "app gid").Default("0").OverrideDefaultFromEnvar("APP_GID").Uint32()
-	env      = app.Flag("env", "app env vars").Short('e').PlaceHolder("key=value").StringMap()
+	appEnv   = app.Flag("env", "app env vars, override any other source").Short('e').PlaceHolder("key=value").StringMap()
 	logLevel = app.Flag("log-level", "log level.").Short('l').PlaceHolder("{debug,info,warn,error,fatal}").Default("info").OverrideDefaultFromEnvar("LOG_LEVEL").Enum(logger.Levels...)
 
+	logFormat      = app.Flag("log-format", "log format.").PlaceHolder("{text,json}").Default("text").OverrideDefaultFromEnvar("LOG_FORMAT").Enum("text", "json")
+	logPassthrough = app.Flag("log-passthrough", "with json logging, pass through app lines that are already JSON objects").OverrideDefaultFromEnvar("LOG_PASSTHROUGH").Bool()
+	logTarget      = app.Flag("log-target", "where escarole and app logs go.").PlaceHolder("{console,syslog,journald}").Default("console").OverrideDefaultFromEnvar("LOG_TARGET").Enum("console", "syslog", "journald")
+	syslogAddr     = app.Flag("syslog-addr", "syslog address for --log-target=syslog, e.g. udp://host:514").Default("unix:///dev/log").OverrideDefaultFromEnvar("SYSLOG_ADDR").String()
+	pinRev         = app.Flag("pin", "check out this sha or tag and do not update").OverrideDefaultFromEnvar("PIN").String()
+	approvalMode   = app.Flag("approval", "apply updates right away or only once approved.").PlaceHolder("{auto,manual}").Default("auto").OverrideDefaultFromEnvar("APPROVAL").Enum("auto", "manual")
+	approvalTTL    = app.Flag("approval-ttl", "how long an approval of an update not upstream yet holds").Default("24h").OverrideDefaultFromEnvar("APPROVAL_TTL").Duration()
+	minAge         = app.Flag("min-commit-age", "only update to upstream commits at least this old").Default("0s").OverrideDefaultFromEnvar("MIN_COMMIT_AGE").Duration()
+	socket         = app.Flag("socket", "control socket of the running escarole").Default("/run/escarole.sock").OverrideDefaultFromEnvar("ESCAROLE_SOCKET").String()
+
+	runCmd      = appArgs(app.Command("run", "clone, run and keep the app updated.").Default())
+	checkCmd    = appArgs(app.Command("check", "validate config, command, remote and permissions without starting the app."))
+	statusCmd   = app.Command("status", "show the state of the running app.")
+	updateCmd   = appArgs(app.Command("update", "update the running app now. With a project and --dry-run, look at the local clone instead."))
+	dryRun      = updateCmd.Flag("dry-run", "only report whether an update is available and which commits it would apply").Bool()
+	restartCmd  = app.Command("restart", "restart the running app.")
+	rollbackCmd = app.Command("rollback", "roll the running app back to the previous sha.")
+	rollbackTo  = rollbackCmd.Arg("sha", "sha or ref to roll back to instead").String()
+	pinCmd      = app.Command("pin", "check out a sha or tag in the running app and stop updating it.")
+	pinTo       = pinCmd.Arg("sha", "sha or tag to pin to").Required().String()
+	unpinCmd    = app.Command("unpin", "let the running app update again after pin.")
+	pauseCmd    = app.Command("pause", "stop updating the running app.")
+	resumeCmd   = app.Command("resume", "update the running app again after pause.")
+	approveCmd  = app.Command("approve", "apply the pending update of the running app, with --approval=manual.")
+	approveSHA  = approveCmd.Arg("sha", "sha or ref to approve instead").String()
+	logsCmd     = app.Command("logs", "show recent output of the running app.")
+	logsLines   = logsCmd.Flag("lines", "number of lines to show").Short('n').Default("100").Int()
+	logsFollow  = logsCmd.Flag("follow", "keep streaming new output").Short('f').Bool()
+	versionCmd  = app.Command("version", "show the escarole version.")
+	initCmd     = app.Command("init", "write a starter config to --config.")
+	initCommand = initCmd.Flag("cmd", "app command").Default("python ${APP_HOME}/main.py").String()
+	initForce   = initCmd.Flag("force", "overwrite an existing config").Bool()
+
+	project = new(string)
+	name    = new(string)
+
 	git    string
 	sha    string
 	ref    string
 	home   = "/src"
 	stdout = []io.Writer{os.Stdout}
+	reload = make(chan struct{}, 1)
 )
 
 func main() {
+	if len(os.Args) > 2 && os.Args[1] == sandboxCmd {
+		sandboxExec(os.Args[2], os.Args[3:])
+	}
+
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	kingpin.Version(version)
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
+	local := *project != "" && *dryRun
+	if cmd != initCmd.FullCommand() && cmd != versionCmd.FullCommand() {
+		// check reports a broken config itself, as long as it has a project.
+		if er := loadConfig(os.Args[1:]); er != nil && (cmd != checkCmd.FullCommand() || *project == "") {
+			app.FatalIfError(er, "")
+		}
+	}
 
-	logger.Configure(*logLevel, "[escarole] ", os.Stdout)
-	logger.Infof("Picking Escarole %v, so leafy!", version)
+	switch cmd {
+	case statusCmd.FullCommand():
+		os.Exit(callControl("status", nil))
+	case restartCmd.FullCommand():
+		os.Exit(callControl("restart", nil))
+	case rollbackCmd.FullCommand():
+		os.Exit(callControl("rollback", url.Values{"sha": {*rollbackTo}}))
+	case pinCmd.FullCommand():
+		os.Exit(callControl("pin", url.Values{"sha": {*pinTo}}))
+	case approveCmd.FullCommand():
+		os.Exit(callControl("approve", url.Values{"sha": {*approveSHA}}))
+	case unpinCmd.FullCommand():
+		os.Exit(callControl("unpin", nil))
+	case pauseCmd.FullCommand():
+		os.Exit(callControl("pause", nil))
+	case resumeCmd.FullCommand():
+		os.Exit(callControl("resume", nil))
+	case logsCmd.FullCommand():
+		os.Exit(tailLogs(*logsLines, *logsFollow))
+	case versionCmd.FullCommand():
+		fmt.Println(version)
+		os.Exit(0)
+	case initCmd.FullCommand():
+		os.Exit(initConfig(*initCommand, *initForce))
+	case updateCmd.FullCommand():
+		if !local {
+			v := url.Values{}
+			if *dryRun {
+				v.Set("dry_run", "1")
+			}
+			os.Exit(callControl("update", v))
+		}
+	}
+
+	if *project == "" {
+		app.Fatalf("no project given, pass it as an argument or set project in %s", *conf)
+	}
+	configureLogging()
+	if *name == "" {
+		*name = strings.ToLower(path.Base(*project))
+	}
+
+	switch cmd {
+	case checkCmd.FullCommand():
+		os.Exit(check())
+	case updateCmd.FullCommand():
+		os.Exit(checkUpdate())
+	}
+
+	logEvent("info", "start", "Picking Escarole %v, so leafy!", version)
 
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	ctx, quit := context.WithCancel(context.Background())
 	go func() {
-		select {
-		case s := <-sig:
+		for s := range sig {
+			if s == syscall.SIGHUP {
+				select {
+				case reload <- struct{}{}:
+				default:
+				}
+				continue
+			}
 			logger.Infof("Got signal %v, terminating", s)
 			quit()
 			time.Sleep(100 * time.Millisecond)
@@ -60,32 +164,59 @@ func main() {
 		logger.Fatalf("Setup failed: %v", er)
 	}
 
+	if er := loadHold(); er != nil {
+		logger.Warnf("Unable to read %s: %v", holdFile, er)
+	}
+	if er := applyPin(); er != nil {
+		quit()
+		logger.Fatalf("%v", er)
+	}
+	last := lastDeployment()
+	previous = last.Old
+	if er := cfg.Build.prepare(ctx, last.SHA); er != nil {
+		quit()
+		logger.Fatalf("Build failed: %v", er)
+	}
+	if last.SHA != sha {
+		deploy("start", last.SHA, sha)
+	}
+
 	app, er := prepareApp(ctx)
 	if er != nil {
 		quit()
-		logger.Fatalf(er.Error())
+		logger.Fatalf("%v", er)
 	}
+	go serveControl(ctx)
 	go run(app, ctx, quit)
 
 	<-ctx.Done()
 }
 
+// appArgs adds the project and name args the app commands share. Both can
+// also come from the config.
+func appArgs(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	cmd.Arg("project", "github project. Format: Organization/Project, e.g. albertrdixon/escarole").StringVar(project)
+	cmd.Arg("name", "app name. If not given will use lowercase project name, e.g. Org/MyProject -> myproject").StringVar(name)
+	return cmd
+}
+
 func setup(c context.Context) error {
 	logger.Infof("Setting HOME to %s", home)
 	if er := os.Setenv("HOME", home); er != nil {
-		logger.Warnf(er.Error())
+		logger.Warnf("%v", er)
 	}
 
 	logger.Infof("Caching git binary location")
-	g, er := exec.LookPath("git")
-	if er != nil {
+	if er := findGit(); er != nil {
 		logger.Fatalf("git not found in path: %v", er)
 	}
-	git = g
 
 	if er := clone(c); er != nil {
 		return er
 	}
+	if er := cfg.Clone.applySparse(); er != nil {
+		return er
+	}
 
 	s, er := getSHA()
 	if er != nil {
@@ -95,8 +226,20 @@ func setup(c context.Context) error {
 	if er != nil {
 		logger.Fatalf("Failed to get ref: %v", er)
 	}
+	if er := cfg.Verify.verify(s); er != nil {
+		return er
+	}
 
-	sha = s
+	setSHA(s)
 	ref = r
 	return nil
 }
+
+func findGit() error {
+	g, er := exec.LookPath("git")
+	if er != nil {
+		return er
+	}
+	git = g
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+)
+
+// testRepo makes home/name a git repo with one commit and points escarole at
+// it, returning the commit.
+func testRepo(t *testing.T) string {
+	t.Helper()
+	g, er := exec.LookPath("git")
+	if er != nil {
+		t.Skip("no git")
+	}
+	git = g
+	home, *name = t.TempDir(), "app"
+	*uid, *gid = uint32(os.Getuid()), uint32(os.Getgid())
+	for k, v := range map[string]string{
+		"GIT_AUTHOR_NAME": "test", "GIT_AUTHOR_EMAIL": "test@example.com",
+		"GIT_COMMITTER_NAME": "test", "GIT_COMMITTER_EMAIL": "test@example.com",
+		"GIT_CONFIG_GLOBAL": "/dev/null", "GIT_CONFIG_NOSYSTEM": "1",
+	} {
+		t.Setenv(k, v)
+	}
+	if er := os.MkdirAll(path.Join(home, *name), 0755); er != nil {
+		t.Fatal(er)
+	}
+	mustGit(t, "init", "-q", "-b", "master")
+	return commitFile(t, "README", "first")
+}
+
+func mustGit(t *testing.T, args ...string) string {
+	t.Helper()
+	out, er := gitOutput(args...)
+	if er != nil {
+		t.Fatal(er)
+	}
+	return out
+}
+
+// commitFile writes body to file and commits it, returning the new sha.
+func commitFile(t *testing.T, file, body string, env ...string) string {
+	t.Helper()
+	if er := os.WriteFile(path.Join(home, *name, file), []byte(body), 0644); er != nil {
+		t.Fatal(er)
+	}
+	mustGit(t, "add", file)
+	if _, er := gitOutputEnv(env, "commit", "-q", "-m", fmt.Sprintf("%s: %s", file, body)); er != nil {
+		t.Fatal(er)
+	}
+	return mustGit(t, "rev-parse", "HEAD")
+}
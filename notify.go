@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/albertrdixon/gearbox/logger"
+)
+
+// Notification events.
+const (
+	eventUpdateApplied = "update_applied"
+	eventUpdateFailed  = "update_failed"
+	eventUpdateRefused = "update_refused"
+	eventUpdatePending = "update_pending"
+	eventRollback      = "rollback"
+	eventCrashLoop     = "crash_loop"
+	eventAppExited     = "app_exited"
+)
+
+// An app exiting crashLoopCount times within crashLoopWindow is crash looping.
+const (
+	crashLoopCount  = 5
+	crashLoopWindow = 10 * time.Minute
+)
+
+const defaultMessage = `{{ .App }}: {{ .Event }}{{ if .Old }} {{ short .Old }}..{{ short .New }}{{ end }}{{ if .Error }}: {{ .Error }}{{ end }}
+{{ range .Commits }}* {{ short .SHA }} {{ .Subject }} ({{ .Author }})
+{{ end }}`
+
+type notifier struct {
+	Type     string   `json:"type"`
+	URL      string   `json:"url"`
+	Events   []string `json:"events"`
+	Template string   `json:"template"`
+
+	// email
+	SMTP     string   `json:"smtp"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	Subject  string   `json:"subject"`
+}
+
+type notification struct {
+	Event   string    `json:"event"`
+	App     string    `json:"app"`
+	Project string    `json:"project"`
+	Branch  string    `json:"branch"`
+	Host    string    `json:"host"`
+	Time    time.Time `json:"time"`
+	Old     string    `json:"old_sha,omitempty"`
+	New     string    `json:"new_sha,omitempty"`
+	Commits []commit  `json:"commits,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Message string    `json:"message"`
+}
+
+// notify fires event at every configured notifier interested in it. old, new
+// and commits may be empty, er may be nil.
+func notify(event, old, new string, commits []commit, er error) {
+	if len(cfg.Notify) < 1 {
+		return
+	}
+
+	n := &notification{
+		Event:   event,
+		App:     *name,
+		Project: *project,
+		Branch:  ref,
+		Time:    time.Now().UTC(),
+		Old:     old,
+		New:     new,
+		Commits: commits,
+	}
+	n.Host, _ = os.Hostname()
+	if er != nil {
+		n.Error = er.Error()
+	}
+
+	for _, nt := range cfg.Notify {
+		if len(nt.Events) > 0 && !matchAny(nt.Events, event) {
+			continue
+		}
+		go func(nt notifier, n notification) {
+			if er := nt.send(&n); er != nil {
+				logger.Errorf("Failed to send %s notification for %s: %v", nt.Type, n.Event, er)
+			}
+		}(nt, *n)
+	}
+}
+
+func (nt notifier) send(n *notification) error {
+	msg, er := nt.render(nt.Template, defaultMessage, n)
+	if er != nil {
+		return er
+	}
+	n.Message = msg
+
+	switch nt.Type {
+	case "webhook":
+		return post(nt.URL, n)
+	case "slack", "mattermost":
+		return post(nt.URL, map[string]string{"text": msg})
+	case "email":
+		return nt.mail(n)
+	}
+	return fmt.Errorf("unknown notification type %q", nt.Type)
+}
+
+func (nt notifier) render(tmpl, def string, n *notification) (string, error) {
+	if tmpl == "" {
+		tmpl = def
+	}
+	t, er := template.New(nt.Type).Funcs(templateFuncs).Funcs(template.FuncMap{"short": short}).Parse(tmpl)
+	if er != nil {
+		return "", er
+	}
+	b := new(bytes.Buffer)
+	if er := t.Execute(b, n); er != nil {
+		return "", er
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+func (nt notifier) mail(n *notification) error {
+	subject, er := nt.render(nt.Subject, "[escarole] {{ .App }} {{ .Event }}", n)
+	if er != nil {
+		return er
+	}
+
+	var auth smtp.Auth
+	if nt.Username != "" {
+		host := nt.SMTP
+		if i := strings.LastIndex(host, ":"); i > 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", nt.Username, os.ExpandEnv(nt.Password), host)
+	}
+
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, "From: %s\r\n", nt.From)
+	fmt.Fprintf(b, "To: %s\r\n", strings.Join(nt.To, ", "))
+	fmt.Fprintf(b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(b, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.Replace(n.Message, "\n", "\r\n", -1))
+	return smtp.SendMail(nt.SMTP, auth, nt.From, nt.To, b.Bytes())
+}
+
+func post(url string, body interface{}) error {
+	b, er := json.Marshal(body)
+	if er != nil {
+		return er
+	}
+	cl := &http.Client{Timeout: 30 * time.Second}
+	resp, er := cl.Post(url, "application/json", bytes.NewReader(b))
+	if er != nil {
+		return er
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hook records the JSON bodies posted to it.
+func hook(t *testing.T) (*httptest.Server, <-chan map[string]interface{}) {
+	t.Helper()
+	got := make(chan map[string]interface{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		var m map[string]interface{}
+		if er := json.Unmarshal(b, &m); er != nil {
+			t.Errorf("bad body %s: %v", b, er)
+		}
+		got <- m
+	}))
+	t.Cleanup(srv.Close)
+	return srv, got
+}
+
+func TestNotify(t *testing.T) {
+	web, webhooks := hook(t)
+	chat, messages := hook(t)
+	*name, *project = "app", "org/app"
+	cfg = &command{Notify: []notifier{
+		{Type: "webhook", URL: web.URL, Events: []string{"update_*"}},
+		{Type: "slack", URL: chat.URL, Events: []string{eventRollback}, Template: "{{ .App }} back to {{ short .New }}"},
+	}}
+
+	commits := []commit{{SHA: "1234567890abcdef", Subject: "fix things", Author: "dev"}}
+	notify(eventUpdateApplied, "aaaaaaaaaaaa", "1234567890abcdef", commits, nil)
+	select {
+	case m := <-webhooks:
+		if m["event"] != eventUpdateApplied || m["app"] != "app" || m["new_sha"] != "1234567890abcdef" {
+			t.Errorf("webhook got %v", m)
+		}
+		msg, _ := m["message"].(string)
+		if !strings.Contains(msg, "aaaaaaaaaa..1234567890") || !strings.Contains(msg, "fix things (dev)") {
+			t.Errorf("default message %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook")
+	}
+
+	notify(eventRollback, "1234567890abcdef", "aaaaaaaaaaaa", nil, nil)
+	select {
+	case m := <-messages:
+		if m["text"] != "app back to aaaaaaaaaa" || len(m) != 1 {
+			t.Errorf("slack got %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no slack message")
+	}
+
+	// Each notifier only gets the events it asked for.
+	select {
+	case m := <-webhooks:
+		t.Errorf("webhook got %v", m)
+	case m := <-messages:
+		t.Errorf("slack got %v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNotifySendFails(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	n := &notification{Event: eventAppExited, App: "app"}
+	if er := (notifier{Type: "webhook", URL: srv.URL}).send(n); er == nil || !strings.Contains(er.Error(), "500") {
+		t.Errorf("got %v", er)
+	}
+	if er := (notifier{Type: "slack", URL: srv.URL, Template: "{{ .Nope }}"}).send(n); er == nil {
+		t.Error("bad template: expected an error")
+	}
+}
+
+func TestCrashLoop(t *testing.T) {
+	now := time.Now()
+	exits := []time.Time{now.Add(-time.Hour), now.Add(-crashLoopWindow / 2), now}
+	if got := crashLoop(exits); len(got) != 2 || !got[0].Equal(exits[1]) {
+		t.Errorf("got %v", got)
+	}
+}
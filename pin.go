@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/albertrdixon/gearbox/logger"
+)
+
+// pinned returns the pin in effect, --pin winning over a control pin.
+func pinned() string {
+	if *pinRev != "" {
+		return *pinRev
+	}
+	return held.Pin
+}
+
+// holdReason says why updates are suspended, if they are.
+func holdReason() string {
+	if p := pinned(); p != "" {
+		return fmt.Sprintf("pinned to %s", p)
+	}
+	if held.Paused {
+		return "updates are paused"
+	}
+	return ""
+}
+
+// resolve returns the full sha of rev after checking it may be deployed.
+func resolve(rev string) (string, error) {
+	full, er := gitOutput("rev-parse", "--verify", rev+"^{commit}")
+	if er != nil {
+		return "", fmt.Errorf("unknown revision %q", rev)
+	}
+	if er := cfg.Verify.verify(full); er != nil {
+		return "", er
+	}
+	return full, nil
+}
+
+// applyPin checks out the pinned sha before the app first starts.
+func applyPin() error {
+	p := pinned()
+	if p == "" {
+		return nil
+	}
+	full, er := resolve(p)
+	if er != nil {
+		return fmt.Errorf("pin: %v", er)
+	}
+	if full != sha {
+		logger.Infof("Pinned to %s, checking out %s", p, short(full))
+		if _, er := gitOutput("reset", "--hard", full); er != nil {
+			return er
+		}
+		if cfg.Clone.submodules() {
+			if er := cfg.Clone.updateSubmodules(); er != nil {
+				return er
+			}
+		}
+		setSHA(full)
+	}
+	return nil
+}
+
+// pin moves the app to rev and keeps it there.
+func (s *supervisor) pin(rev string) error {
+	if *pinRev != "" && rev != *pinRev {
+		return fmt.Errorf("pinned to %s by --pin", *pinRev)
+	}
+	full, er := resolve(rev)
+	if er != nil {
+		return er
+	}
+	if full != sha {
+		logEvent("warn", "pin", "Pinning %v to %s (%s)", s.app, rev, short(full))
+		if er := s.moveTo("pin", full); er != nil {
+			return er
+		}
+	}
+	// Keep the sha, a relative rev would move with HEAD.
+	held.Pin = full
+	return held.save()
+}
+
+func (s *supervisor) unpin() error {
+	if *pinRev != "" {
+		return fmt.Errorf("pinned to %s by --pin", *pinRev)
+	}
+	if held.Pin == "" {
+		return fmt.Errorf("%s is not pinned", *name)
+	}
+	logEvent("info", "unpin", "Unpinning %v from %s", s.app, held.Pin)
+	held.Pin = ""
+	return held.save()
+}
+
+func (s *supervisor) pause(paused bool) error {
+	held.Paused = paused
+	if paused {
+		logEvent("info", "pause", "Pausing updates of %v", s.app)
+	} else {
+		logEvent("info", "resume", "Resuming updates of %v", s.app)
+	}
+	return held.save()
+}
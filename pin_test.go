@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPin(t *testing.T) {
+	base := testRepo(t)
+	setSHA(base)
+	cfg = new(command)
+	held, *pinRev = new(hold), ""
+	s, log := testSupervisor(t)
+	head := commitFile(t, "a", "new")
+	mustGit(t, "tag", "v1", base)
+
+	if ok, er := s.finish(head, nil); !ok || er != nil {
+		t.Fatalf("finish: %v", er)
+	}
+	step(t, s)
+	if er := s.pin("v1"); er != nil {
+		t.Fatal(er)
+	}
+	step(t, s)
+	if shas := startedOn(t, log, 3); shas[2] != base || held.Pin != base {
+		t.Errorf("started on %v, pinned to %q", shas, held.Pin)
+	}
+	if why := holdReason(); !strings.Contains(why, "pinned") {
+		t.Errorf("hold reason %q", why)
+	}
+	if er := s.rollback(""); er == nil {
+		t.Error("rolled back while pinned")
+	}
+	if er := s.pin("nope"); er == nil {
+		t.Error("pinned an unknown rev")
+	}
+
+	// The pin is kept by sha and survives an escarole restart.
+	held = new(hold)
+	if er := loadHold(); er != nil || held.Pin != base {
+		t.Errorf("pin %q after reload, %v", held.Pin, er)
+	}
+	if er := s.unpin(); er != nil || held.Pin != "" || holdReason() != "" {
+		t.Errorf("unpin: %v, pin %q", er, held.Pin)
+	}
+	if er := s.unpin(); er == nil {
+		t.Error("unpinned twice")
+	}
+}
+
+func TestPinFlag(t *testing.T) {
+	base := testRepo(t)
+	head := commitFile(t, "a", "new")
+	setSHA(head)
+	cfg = new(command)
+	held, *pinRev = new(hold), base
+	defer func() { *pinRev = "" }()
+
+	// --pin checks out its sha before the app starts and cannot be undone.
+	if er := applyPin(); er != nil {
+		t.Fatal(er)
+	}
+	if sha != base || mustGit(t, "rev-parse", "HEAD") != base {
+		t.Errorf("at %s", sha)
+	}
+	s := &supervisor{}
+	if er := s.unpin(); er == nil {
+		t.Error("unpinned --pin")
+	}
+	if er := s.pin(head); er == nil {
+		t.Error("pinned elsewhere over --pin")
+	}
+}
+
+func TestPause(t *testing.T) {
+	testRepo(t)
+	held, *pinRev = new(hold), ""
+	s := &supervisor{}
+
+	if er := s.pause(true); er != nil {
+		t.Fatal(er)
+	}
+	if why := holdReason(); why != "updates are paused" {
+		t.Errorf("hold reason %q", why)
+	}
+	held = new(hold)
+	if er := loadHold(); er != nil || !held.Paused {
+		t.Errorf("paused %v after reload, %v", held.Paused, er)
+	}
+	if er := s.pause(false); er != nil || holdReason() != "" {
+		t.Errorf("resume: %v, hold reason %q", er, holdReason())
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/albertrdixon/gearbox/logger"
+	"golang.org/x/net/context"
+)
+
+// rejected is an upstream sha that failed its preflight and is not tried
+// again until upstream moves on.
+var rejected string
+
+// preflight runs commands against a new sha, checked out in a worktree of its
+// own, before the live checkout moves to it.
+type preflight struct {
+	Run     []string `json:"run"`
+	Timeout duration `json:"timeout"`
+}
+
+func (p *preflight) enabled() bool {
+	return p != nil && len(p.Run) > 0
+}
+
+func (p *preflight) validate() error {
+	if p == nil {
+		return nil
+	}
+	if len(p.Run) < 1 {
+		return errors.New("no run commands given")
+	}
+	for i, r := range p.Run {
+		if strings.TrimSpace(r) == "" {
+			return fmt.Errorf("command %d is empty", i+1)
+		}
+	}
+	return nil
+}
+
+// test checks out sha and runs the commands in order as the app user, with
+// APP_HOME set to the checkout and APP_PREFLIGHT=1. A failing command is
+// returned as unverified.
+func (p *preflight) test(c context.Context, sha string) error {
+	if !p.enabled() {
+		return nil
+	}
+	dir := path.Join(stateDir(), "preflight")
+	if er := os.RemoveAll(dir); er != nil {
+		return er
+	}
+	gitOutput("worktree", "prune")
+	if er := os.MkdirAll(dir, 0755); er != nil {
+		return er
+	}
+	if er := os.Chown(dir, int(*uid), int(*gid)); er != nil {
+		return er
+	}
+	defer func() {
+		if er := os.RemoveAll(dir); er != nil {
+			logger.Warnf("Unable to remove %s: %v", dir, er)
+		}
+		gitOutput("worktree", "prune")
+	}()
+
+	logEvent("info", "preflight", "Testing %s", short(sha))
+	if _, er := gitOutput("worktree", "add", "--detach", dir, sha); er != nil {
+		return er
+	}
+	if cfg.Clone.submodules() {
+		if _, er := gitOutput("-C", dir, "submodule", "update", "--init", "--recursive"); er != nil {
+			return er
+		}
+	}
+
+	e, er := cfg.Env.compose()
+	if er != nil {
+		return er
+	}
+	e = append(e, "APP_HOME="+dir, "APP_SHA="+sha, "APP_PREFLIGHT=1")
+	venv, er := cfg.Build.venv(c, dir, sha)
+	if er != nil {
+		return &unverified{sha, fmt.Sprintf("preflight install failed: %v", er)}
+	}
+	if venv != "" {
+		env := envMap(e)
+		prependPath(env, path.Join(venv, "bin"))
+		e = append(e, "VIRTUAL_ENV="+venv, "PATH="+env["PATH"])
+	}
+
+	for i, cmd := range p.Run {
+		logger.Infof("Running %q", cmd)
+		r := &rule{Run: cmd, Timeout: p.Timeout, root: dir}
+		if er := r.run(c, e); er != nil {
+			return &unverified{sha, fmt.Sprintf("preflight command %d %q failed: %v", i+1, cmd, er)}
+		}
+	}
+	logger.Infof("Preflight of %s passed", short(sha))
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestPreflight(t *testing.T) {
+	base := testRepo(t)
+	cfg = new(command)
+	out := path.Join(t.TempDir(), "sha")
+	head := commitFile(t, "check.sh", "test -n \"$APP_PREFLIGHT\" && test \"$APP_HOME\" = \"$PWD\" && echo $APP_SHA > "+out)
+	mustGit(t, "reset", "-q", "--hard", base)
+
+	p := &preflight{Run: []string{"true", "sh check.sh"}}
+	if er := p.test(context.Background(), head); er != nil {
+		t.Fatal(er)
+	}
+	if b, _ := os.ReadFile(out); strings.TrimSpace(string(b)) != head {
+		t.Errorf("APP_SHA = %q, want %s", b, head)
+	}
+
+	// The live checkout stays put and the worktree is gone afterwards.
+	if at := mustGit(t, "rev-parse", "HEAD"); at != base {
+		t.Errorf("live checkout moved to %s", at)
+	}
+	if exists(path.Join(stateDir(), "preflight")) {
+		t.Error("worktree left behind")
+	}
+	if wt := mustGit(t, "worktree", "list"); strings.Contains(wt, "preflight") {
+		t.Errorf("worktree still registered: %s", wt)
+	}
+
+	// Commands run in order and the first failing one refuses the sha.
+	os.Remove(out)
+	p = &preflight{Run: []string{"false", "touch " + out}}
+	er := p.test(context.Background(), head)
+	if _, ok := er.(*unverified); !ok || !strings.Contains(er.Error(), `command 1 "false"`) {
+		t.Errorf("got %v", er)
+	}
+	if exists(out) {
+		t.Error("ran past a failing command")
+	}
+	if er := p.test(context.Background(), base); er == nil {
+		t.Error("check.sh passed on a sha without it")
+	}
+}
+
+func TestPreflightValidate(t *testing.T) {
+	if er := (*preflight)(nil).validate(); er != nil {
+		t.Errorf("no preflight: %v", er)
+	}
+	if er := new(preflight).validate(); er == nil {
+		t.Error("no commands: expected an error")
+	}
+	if er := (&preflight{Run: []string{"make test", " "}}).validate(); er == nil || !strings.Contains(er.Error(), "command 2") {
+		t.Errorf("empty command: got %v", er)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/albertrdixon/gearbox/logger"
+	"golang.org/x/net/context"
+)
+
+// appProcess runs the app. It works like gearbox's process.Process, which
+// the git commands still use, but keeps stderr writers apart from stdout
+// ones and starts the app in its cgroup, if it has one.
+type appProcess struct {
+	*exec.Cmd
+	name, bin, dir string
+	args, env      []string
+	cred           *syscall.Credential
+	cgroup         string
+	c              context.Context
+	out, errOut    []io.Writer
+}
+
+func newAppProcess(name string, cmd []string, out ...io.Writer) (*appProcess, error) {
+	if len(cmd) < 1 {
+		return nil, errors.New("Bad command")
+	}
+	bin, er := exec.LookPath(cmd[0])
+	if er != nil {
+		return nil, er
+	}
+	if len(out) < 1 {
+		out = []io.Writer{os.Stdout}
+	}
+	return &appProcess{
+		name: name,
+		bin:  bin,
+		args: cmd[1:],
+		out:  out,
+	}, nil
+}
+
+func (p *appProcess) String() string {
+	pid := p.Pid()
+	if pid == -1 {
+		return p.name
+	}
+	return fmt.Sprintf("%s(pid=%d)", p.name, pid)
+}
+
+func (p *appProcess) AddWriter(w io.Writer) *appProcess {
+	p.out = append(p.out, w)
+	return p
+}
+
+// AddErrWriter adds a writer for stderr only. Without any, stderr goes to
+// the stdout writers.
+func (p *appProcess) AddErrWriter(w io.Writer) *appProcess {
+	p.errOut = append(p.errOut, w)
+	return p
+}
+
+func (p *appProcess) SetDir(dir string) *appProcess {
+	p.dir = dir
+	return p
+}
+
+func (p *appProcess) SetEnv(env []string) *appProcess {
+	p.env = env
+	return p
+}
+
+func (p *appProcess) SetUser(uid, gid uint32) *appProcess {
+	p.cred = &syscall.Credential{Uid: uid, Gid: gid}
+	return p
+}
+
+func (p *appProcess) Pid() int {
+	if p.Cmd != nil && p.Cmd.Process != nil {
+		return p.Process.Pid
+	}
+	return -1
+}
+
+// Exited is closed once the last started app has exited.
+func (p *appProcess) Exited() <-chan struct{} {
+	return p.c.Done()
+}
+
+// Execute starts the app, which is killed once ctx is done.
+func (p *appProcess) Execute(ctx context.Context) error {
+	p.Cmd = exec.Command(p.bin, p.args...)
+	p.Cmd.Dir = p.dir
+	if len(p.env) > 0 {
+		p.Cmd.Env = p.env
+	}
+	p.Cmd.SysProcAttr = &syscall.SysProcAttr{Credential: p.cred}
+	done, er := joinCgroup(p.Cmd.SysProcAttr, p.cgroup)
+	if er != nil {
+		return er
+	}
+	defer done()
+
+	sto, er := p.StdoutPipe()
+	if er != nil {
+		return er
+	}
+	ste, er := p.StderrPipe()
+	if er != nil {
+		return er
+	}
+
+	c, cancel := context.WithCancel(context.Background())
+	p.c = c
+
+	errOut := p.errOut
+	if len(errOut) < 1 {
+		errOut = p.out
+	}
+	go p.stream(sto, p.out)
+	go p.stream(ste, errOut)
+
+	if er := p.Start(); er != nil {
+		cancel()
+		return er
+	}
+
+	cmd := p.Cmd
+	go func() {
+		select {
+		case <-c.Done():
+		case <-ctx.Done():
+			cmd.Process.Kill()
+		}
+	}()
+	go func() {
+		cmd.Wait()
+		logger.Debugf("%v exited", p)
+		cancel()
+	}()
+	return nil
+}
+
+// stream copies lines from r to out as "[name] line".
+func (p *appProcess) stream(r io.Reader, out []io.Writer) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		for _, w := range out {
+			fmt.Fprintf(w, "[%s] %s\n", p.name, s.Text())
+		}
+	}
+	// Wait closes the pipes once the app exited.
+	if er := s.Err(); er != nil && !errors.Is(er, os.ErrClosed) {
+		logger.Errorf("%v stream error: %v", p, er)
+	}
+}
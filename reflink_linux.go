@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is FICLONE, as in golang.org/x/sys/unix.
+const ficlone = 0x40049409
+
+// reflink makes dst share src's blocks copy on write, where the file system
+// supports it (btrfs, XFS).
+func reflink(dst, src *os.File) error {
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if e != 0 {
+		return e
+	}
+	return nil
+}
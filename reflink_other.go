@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func reflink(dst, src *os.File) error {
+	return errors.New("reflinks are not supported on this platform")
+}
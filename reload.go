@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/albertrdixon/gearbox/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultReloadTimeout = 30 * time.Second
+	reloadGrace          = time.Second
+)
+
+var signals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"WINCH": syscall.SIGWINCH,
+	"TTIN":  syscall.SIGTTIN,
+	"TTOU":  syscall.SIGTTOU,
+}
+
+// reloadCheck confirms the app took a reload signal: http has to answer 2xx
+// and log_match has to match a line of app output, both within timeout.
+type reloadCheck struct {
+	HTTP     string   `json:"http"`
+	LogMatch string   `json:"log_match"`
+	Timeout  duration `json:"timeout"`
+}
+
+func parseSignal(name string) (syscall.Signal, error) {
+	s, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal %q", name)
+	}
+	return s, nil
+}
+
+func (r *reloadCheck) validate() error {
+	if r == nil {
+		return nil
+	}
+	if r.HTTP == "" && r.LogMatch == "" {
+		return errors.New("no http or log_match given")
+	}
+	if _, er := regexp.Compile(r.LogMatch); er != nil {
+		return fmt.Errorf("log_match: %v", er)
+	}
+	return nil
+}
+
+// refresh applies an update by signalling the app with reload_signal, falling
+// back to a full restart if that is not set or the reload is not confirmed.
+// With down, which has to run while the app is stopped, or an app that is
+// not running, it always restarts.
+func (s *supervisor) refresh(head string, down func() error) error {
+	if cfg.ReloadSignal == "" || down != nil || !s.running() {
+		logEvent("info", "restart", "Restarting %v", s.app)
+		return s.restartWith(down)
+	}
+	sig, er := parseSignal(cfg.ReloadSignal)
+	if er == nil {
+		var lines <-chan string
+		if cfg.ReloadCheck != nil && cfg.ReloadCheck.LogMatch != "" {
+			l, cancel := recent.subscribe()
+			defer cancel()
+			lines = l
+		}
+
+		logEvent("info", "reload", "Reloading %v on %s with %v", s.app, short(head), sig)
+		if er = s.app.Process.Signal(sig); er == nil {
+			if er = cfg.ReloadCheck.confirm(s.c, lines, s.app.Exited()); er == nil {
+				logger.Infof("Reloaded %v", s.app)
+				s.status.Reloads++
+				return nil
+			}
+		}
+	}
+
+	logEvent("warn", "reload_failed", "Reload of %v failed, restarting: %v", s.app, er)
+	select {
+	case <-s.app.Exited():
+		// The loop starts it again.
+		s.stopped = true
+		return nil
+	default:
+	}
+	return s.restart()
+}
+
+// confirm waits for the checks to pass, or just a moment without any, and
+// fails if the app exits meanwhile.
+func (r *reloadCheck) confirm(c context.Context, lines <-chan string, exited <-chan struct{}) error {
+	if r == nil {
+		select {
+		case <-exited:
+			return errors.New("app exited")
+		case <-time.After(reloadGrace):
+			return nil
+		}
+	}
+
+	timeout := time.Duration(r.Timeout)
+	if timeout <= 0 {
+		timeout = defaultReloadTimeout
+	}
+	var re *regexp.Regexp
+	if r.LogMatch != "" {
+		re = regexp.MustCompile(r.LogMatch)
+	}
+	matched, healthy := re == nil, r.HTTP == ""
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	tick := time.NewTicker(reloadGrace)
+	defer tick.Stop()
+	cl := &http.Client{Timeout: reloadGrace}
+
+	for !matched || !healthy {
+		select {
+		case <-c.Done():
+			return c.Err()
+		case <-exited:
+			return errors.New("app exited")
+		case <-deadline.C:
+			if !matched {
+				return fmt.Errorf("no output matching %q within %v", r.LogMatch, timeout)
+			}
+			return fmt.Errorf("%s not healthy within %v", r.HTTP, timeout)
+		case l, ok := <-lines:
+			if !ok {
+				// No more output to match, wait for the deadline.
+				lines = nil
+				continue
+			}
+			l = strings.TrimPrefix(strings.TrimSuffix(l, "\n"), "["+*name+"] ")
+			matched = matched || re.MatchString(l)
+		case <-tick.C:
+			if healthy {
+				continue
+			}
+			if resp, er := cl.Get(r.HTTP); er == nil {
+				resp.Body.Close()
+				healthy = resp.StatusCode >= 200 && resp.StatusCode <= 299
+			}
+		}
+	}
+	return nil
+}
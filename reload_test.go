@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestReloadConfirm(t *testing.T) {
+	*name = "app"
+	r := &reloadCheck{LogMatch: "^reloaded", Timeout: duration(3 * time.Second)}
+	c := context.Background()
+
+	lines := make(chan string, 2)
+	lines <- "[app] starting\n"
+	lines <- "[app] reloaded config\n"
+	if er := r.confirm(c, lines, nil); er != nil {
+		t.Errorf("matching line: %v", er)
+	}
+
+	// A closed channel is not output, even for a pattern matching "".
+	closed := make(chan string)
+	close(closed)
+	empty := &reloadCheck{LogMatch: "x*", Timeout: duration(time.Second)}
+	if er := empty.confirm(c, closed, nil); er == nil || !strings.Contains(er.Error(), "no output matching") {
+		t.Errorf("closed lines: got %v", er)
+	}
+
+	exited := make(chan struct{})
+	close(exited)
+	if er := r.confirm(c, make(chan string), exited); er == nil {
+		t.Errorf("exited app: expected an error")
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	for _, s := range []string{"HUP", "SIGHUP", "hup"} {
+		if sig, er := parseSignal(s); er != nil || sig.String() != "hangup" {
+			t.Errorf("parseSignal(%q) = %v, %v", s, sig, er)
+		}
+	}
+	if _, er := parseSignal("KILL"); er == nil {
+		t.Errorf("KILL must not be a reload signal")
+	}
+}
+
+func TestReadValidatesReload(t *testing.T) {
+	file := path.Join(t.TempDir(), "app.yml")
+	for _, body := range []string{
+		"cmd: run\nreload_signal: HUPP",
+		"cmd: run\nreload_signal: HUP\nreload_check: {timeout: 5s}",
+		"cmd: run\nreload_signal: HUP\nreload_check: {log_match: \"(\"}",
+	} {
+		os.WriteFile(file, []byte(body), 0644)
+		if _, er := read(file); er == nil {
+			t.Errorf("%q: expected an error", body)
+		}
+	}
+}
+
+func TestRefreshBadSignal(t *testing.T) {
+	base := testRepo(t)
+	setSHA(base)
+	cfg = &command{ReloadSignal: "HUPP"}
+	s, log := testSupervisor(t)
+
+	if er := s.refresh(base, nil); er != nil {
+		t.Fatal(er)
+	}
+	step(t, s)
+	startedOn(t, log, 2)
+	if s.status.Reloads != 0 {
+		t.Errorf("counted %d reloads", s.status.Reloads)
+	}
+}
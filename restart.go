@@ -0,0 +1,106 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/albertrdixon/gearbox/logger"
+)
+
+// restartFilter picks the changed paths that need the app restarted. Without
+// include every path counts, exclude wins over include.
+type restartFilter struct {
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+}
+
+// needed reports whether any of files passes the filter and logs why. Unknown
+// changes, a nil files, always need a restart.
+func (f *restartFilter) needed(files []string) bool {
+	if f == nil || len(files) < 1 {
+		return true
+	}
+
+	var hits, ignored []string
+	for _, file := range files {
+		if (len(f.Include) < 1 || matchPaths(f.Include, file)) && !matchPaths(f.Exclude, file) {
+			hits = append(hits, file)
+		} else {
+			ignored = append(ignored, file)
+		}
+	}
+	if len(ignored) > 0 {
+		logger.Infof("Changes not needing a restart: %s", strings.Join(ignored, ", "))
+	}
+	if len(hits) > 0 {
+		logger.Infof("Changes needing a restart: %s", strings.Join(hits, ", "))
+		return true
+	}
+	return false
+}
+
+// changedFiles lists the paths that differ between old and new. The list is
+// nil if that is unknown, without old or on error.
+func changedFiles(old, new string) ([]string, error) {
+	if old == "" {
+		return nil, nil
+	}
+	if old == new {
+		return []string{}, nil
+	}
+	out, er := gitOutput("diff", "--name-only", "-z", old, new)
+	if er != nil {
+		return nil, er
+	}
+	return splitNUL(out), nil
+}
+
+func matchPaths(patterns []string, file string) bool {
+	for _, p := range patterns {
+		if matchPath(p, file) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath matches file against a gitignore style glob: a pattern without a
+// slash matches the base name anywhere, ** spans directories and a trailing
+// slash matches everything below a directory.
+func matchPath(pattern, file string) bool {
+	if !strings.Contains(strings.TrimSuffix(pattern, "/"), "/") && !strings.HasSuffix(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(file))
+		return ok
+	}
+	pattern = strings.TrimPrefix(pattern, "/")
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "**"
+	}
+	re, er := regexp.Compile("^" + globRegexp(pattern) + "$")
+	if er != nil {
+		return false
+	}
+	return re.MatchString(file)
+}
+
+func globRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern, file string
+		want          bool
+	}{
+		{"*.py", "main.py", true},
+		{"*.py", "app/lib/util.py", true},
+		{"*.py", "main.pyc", false},
+		{"requirements*.txt", "requirements-dev.txt", true},
+		{"?.md", "a.md", true},
+		{"?.md", "ab.md", false},
+		{"docs/", "docs/index.md", true},
+		{"docs/", "docs/api/v1.md", true},
+		{"docs/", "src/docs/index.md", false},
+		{"/docs/", "docs/index.md", true},
+		{"src/*.go", "src/main.go", true},
+		{"src/*.go", "src/sub/main.go", false},
+		{"src/**/*.go", "src/main.go", true},
+		{"src/**/*.go", "src/a/b/main.go", true},
+		{"src/**", "src/a/b", true},
+		{"**/test/*", "a/b/test/x", true},
+		{"**/test/*", "test/x", true},
+		{"a+b/c.txt", "a+b/c.txt", true},
+		{"a+b/c.txt", "aab/c.txt", false},
+	}
+	for _, tt := range tests {
+		if got := matchPath(tt.pattern, tt.file); got != tt.want {
+			t.Errorf("matchPath(%q, %q) = %v, want %v", tt.pattern, tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestGlobRegexp(t *testing.T) {
+	tests := map[string]string{
+		"*.py":        `[^/]*\.py`,
+		"a/**/b":      `a/(.*/)?b`,
+		"a/**":        `a/.*`,
+		"x?.(1)":      `x[^/]\.\(1\)`,
+		"docs/**/*.*": `docs/(.*/)?[^/]*\.[^/]*`,
+	}
+	for glob, want := range tests {
+		if got := globRegexp(glob); got != want {
+			t.Errorf("globRegexp(%q) = %q, want %q", glob, got, want)
+		}
+	}
+}
+
+func TestChangedFiles(t *testing.T) {
+	base := testRepo(t)
+	os.Mkdir(path.Join(home, *name, "my dir"), 0755)
+	commitFile(t, "a b.txt", "x")
+	head := commitFile(t, "my dir/\"c\".py", "y")
+
+	tests := []struct {
+		old, new string
+		want     []string
+	}{
+		{base, head, []string{"a b.txt", "my dir/\"c\".py"}},
+		{head, head, []string{}},
+		{"", head, nil},
+	}
+	for _, tt := range tests {
+		got, er := changedFiles(tt.old, tt.new)
+		if er != nil {
+			t.Fatal(er)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("changedFiles(%.7s, %.7s) = %#v, want %#v", tt.old, tt.new, got, tt.want)
+		}
+	}
+}
+
+func TestRestartNeeded(t *testing.T) {
+	f := &restartFilter{Include: []string{"*.py", "templates/"}, Exclude: []string{"tests/"}}
+	tests := []struct {
+		files []string
+		want  bool
+	}{
+		{nil, true},
+		{[]string{"README.md"}, false},
+		{[]string{"README.md", "app/main.py"}, true},
+		{[]string{"tests/test_main.py"}, false},
+		{[]string{"templates/index.html"}, true},
+	}
+	for _, tt := range tests {
+		if got := f.needed(tt.files); got != tt.want {
+			t.Errorf("needed(%v) = %v, want %v", tt.files, got, tt.want)
+		}
+	}
+	if !(*restartFilter)(nil).needed([]string{"README.md"}) {
+		t.Errorf("no filter must always restart")
+	}
+}
+
+func TestRunRules(t *testing.T) {
+	dir := t.TempDir()
+	home, *name = dir, "app"
+	*uid, *gid = uint32(os.Getuid()), uint32(os.Getgid())
+	if er := os.MkdirAll(path.Join(dir, *name), 0755); er != nil {
+		t.Fatal(er)
+	}
+
+	rules := []rule{
+		{Paths: []string{"*.py"}, Run: "touch " + dir + "/out/py"},
+		{Paths: []string{"docs/"}, Run: "touch " + dir + "/out/docs"},
+		{Run: "touch " + dir + "/out/always"},
+	}
+	tests := []struct {
+		files []string
+		want  []string
+	}{
+		{[]string{"app/main.py"}, []string{"always", "py"}},
+		{[]string{}, []string{"always"}},
+		{nil, []string{"always", "docs", "py"}},
+	}
+	for _, tt := range tests {
+		out := path.Join(dir, "out")
+		os.RemoveAll(out)
+		os.Mkdir(out, 0755)
+		if er := runRules(context.Background(), rules, tt.files, "abc"); er != nil {
+			t.Fatal(er)
+		}
+		list, _ := os.ReadDir(out)
+		var ran []string
+		for _, e := range list {
+			ran = append(ran, e.Name())
+		}
+		sort.Strings(ran)
+		if !reflect.DeepEqual(ran, tt.want) {
+			t.Errorf("files %#v: ran %v, want %v", tt.files, ran, tt.want)
+		}
+	}
+}
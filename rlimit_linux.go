@@ -0,0 +1,10 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package main
+
+// Resources syscall does not export, as in golang.org/x/sys/unix.
+const (
+	rlimitNproc   = 0x6
+	rlimitMemlock = 0x8
+)
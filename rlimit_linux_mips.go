@@ -0,0 +1,11 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+// +build linux
+// +build mips mipsle mips64 mips64le
+
+package main
+
+// Resources syscall does not export, as in golang.org/x/sys/unix.
+const (
+	rlimitNproc   = 0x8
+	rlimitMemlock = 0x9
+)
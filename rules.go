@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/albertrdixon/gearbox/logger"
+	"golang.org/x/net/context"
+)
+
+// rule runs a command when an update changes a file matching one of paths.
+type rule struct {
+	Paths   []string `json:"paths"`
+	Run     string   `json:"run"`
+	Dir     string   `json:"dir"`
+	Timeout duration `json:"timeout"`
+
+	root string
+}
+
+// runRules runs, in order, the rules matching any of files as the app user
+// with the app env for head. Rules without paths always run, and so do all
+// rules if files is nil, the changes being unknown. The first failing rule
+// stops the rest.
+func runRules(c context.Context, rules []rule, files []string, head string) error {
+	var env []string
+	for i, r := range rules {
+		hit := ""
+		for _, f := range files {
+			if matchPaths(r.Paths, f) {
+				hit = f
+				break
+			}
+		}
+		if hit == "" && r.Paths != nil && files != nil {
+			continue
+		}
+
+		if env == nil {
+			e, er := cfg.Env.compose()
+			if er != nil {
+				return er
+			}
+			env = append(e, "APP_SHA="+head)
+		}
+		if hit != "" {
+			logEvent("info", "rule", "%s changed, running %q", hit, r.Run)
+		} else {
+			logEvent("info", "rule", "Running %q", r.Run)
+		}
+		if er := r.run(c, env); er != nil {
+			return fmt.Errorf("rule %d %q: %v", i+1, r.Run, er)
+		}
+	}
+	return nil
+}
+
+func (r *rule) run(c context.Context, env []string) error {
+	args := strings.Fields(expand(r.Run, envMap(env)))
+	if len(args) < 1 {
+		return errors.New("empty command")
+	}
+	if bin, er := lookPath(args[0], envMap(env)); er == nil {
+		args[0] = bin
+	}
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		c, cancel = context.WithTimeout(c, time.Duration(r.Timeout))
+		defer cancel()
+	}
+
+	dir := r.root
+	if dir == "" {
+		dir = path.Join(home, *name)
+	}
+	if r.Dir != "" {
+		dir = path.Join(dir, r.Dir)
+	}
+	out := new(bytes.Buffer)
+	cmd := exec.CommandContext(c, args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: *uid, Gid: *gid},
+	}
+
+	er := cmd.Run()
+	s := bufio.NewScanner(out)
+	for s.Scan() {
+		logger.Infof("[%s] %s", path.Base(args[0]), s.Text())
+	}
+	if c.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v", time.Duration(r.Timeout))
+	}
+	return er
+}
+
+func (r *rule) validate() error {
+	if len(r.Paths) < 1 {
+		return errors.New("no paths given")
+	}
+	if strings.TrimSpace(r.Run) == "" {
+		return errors.New("no run command given")
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/units"
+)
+
+// sandboxCmd is the hidden argv[1] escarole re-executes itself with to apply
+// limits that cannot be expressed in a SysProcAttr before exec'ing the app.
+const sandboxCmd = "__sandbox"
+
+type limits struct {
+	Rlimits          map[string]rlimit `json:"rlimits"`
+	Umask            string            `json:"umask"`
+	NoNewPrivs       bool              `json:"no_new_privs"`
+	DropCapabilities bool              `json:"drop_capabilities"`
+	Cgroup           *cgroupLimits     `json:"cgroup"`
+}
+
+type cgroupLimits struct {
+	Memory byteSize `json:"memory"`
+	CPU    float64  `json:"cpu"`
+	Pids   int64    `json:"pids"`
+}
+
+// sandboxSpec is what the parent hands to the sandbox shim on its command line.
+// The shim starts with escarole's credentials and switches to UID and GID
+// itself once the limits are in place.
+type sandboxSpec struct {
+	Rlimits    map[int][2]uint64 `json:"r,omitempty"`
+	Umask      int               `json:"u"`
+	NoNewPrivs bool              `json:"n,omitempty"`
+	DropCaps   bool              `json:"c,omitempty"`
+	UID        uint32            `json:"uid"`
+	GID        uint32            `json:"gid"`
+}
+
+// rlimit is a soft:hard pair. A single value sets both.
+type rlimit struct {
+	Cur, Max uint64
+}
+
+func (r *rlimit) UnmarshalJSON(b []byte) error {
+	var s string
+	if er := json.Unmarshal(b, &s); er != nil {
+		s = string(b)
+	}
+
+	parts := strings.SplitN(s, ":", 2)
+	cur, er := parseLimit(parts[0])
+	if er != nil {
+		return er
+	}
+	max := cur
+	if len(parts) > 1 {
+		if max, er = parseLimit(parts[1]); er != nil {
+			return er
+		}
+	}
+	if cur > max {
+		return fmt.Errorf("rlimit %q: soft limit exceeds hard limit", s)
+	}
+	r.Cur, r.Max = cur, max
+	return nil
+}
+
+func parseLimit(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	switch s {
+	case "unlimited", "infinity":
+		return math.MaxUint64, nil
+	}
+	if n, er := strconv.ParseUint(s, 10, 64); er == nil {
+		return n, nil
+	}
+	n, er := units.ParseBase2Bytes(s)
+	if er != nil || n < 0 {
+		return 0, fmt.Errorf("bad limit %q", s)
+	}
+	return uint64(n), nil
+}
+
+func (l *limits) spec() (*sandboxSpec, error) {
+	sp := &sandboxSpec{
+		Umask:      -1,
+		NoNewPrivs: l.NoNewPrivs,
+		DropCaps:   l.DropCapabilities,
+		UID:        *uid,
+		GID:        *gid,
+	}
+	if l.Umask != "" {
+		u, er := strconv.ParseUint(l.Umask, 8, 32)
+		if er != nil || u > 0777 {
+			return nil, fmt.Errorf("bad umask %q", l.Umask)
+		}
+		sp.Umask = int(u)
+	}
+	if len(l.Rlimits) > 0 {
+		sp.Rlimits = make(map[int][2]uint64, len(l.Rlimits))
+	}
+	for k, v := range l.Rlimits {
+		res, ok := rlimitResources[strings.ToLower(k)]
+		if !ok {
+			return nil, fmt.Errorf("unknown rlimit %q", k)
+		}
+		sp.Rlimits[res] = [2]uint64{v.Cur, v.Max}
+	}
+	return sp, nil
+}
+
+// sandboxed reports whether the app is started through the sandbox shim.
+func (l *limits) sandboxed() bool {
+	return l != nil && (len(l.Rlimits) > 0 || l.Umask != "" || l.NoNewPrivs || l.DropCapabilities)
+}
+
+// wrap prefixes cmd with the sandbox shim if any exec-time limits are set.
+func (l *limits) wrap(cmd []string) ([]string, error) {
+	if !l.sandboxed() {
+		return cmd, nil
+	}
+	if !sandboxSupported {
+		return nil, fmt.Errorf("resource limits are not supported on this platform")
+	}
+
+	sp, er := l.spec()
+	if er != nil {
+		return nil, er
+	}
+	b, er := json.Marshal(sp)
+	if er != nil {
+		return nil, er
+	}
+	self, er := os.Executable()
+	if er != nil {
+		return nil, er
+	}
+	return append([]string{self, sandboxCmd, base64.RawURLEncoding.EncodeToString(b)}, cmd...), nil
+}
+
+func decodeSpec(s string) (*sandboxSpec, error) {
+	b, er := base64.RawURLEncoding.DecodeString(s)
+	if er != nil {
+		return nil, er
+	}
+	sp := new(sandboxSpec)
+	return sp, json.Unmarshal(b, sp)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/albertrdixon/gearbox/logger"
+)
+
+const (
+	sandboxSupported = true
+
+	cgroupRoot = "/sys/fs/cgroup"
+
+	prCapbsetDrop       = 24
+	prSetNoNewPrivs     = 38
+	prCapAmbient        = 47
+	prCapAmbientClear   = 4
+	linuxCapVersion3    = 0x20080522
+	defaultCapLast      = 40
+	supervisorCgroup    = "escarole"
+	cgroupControllerSet = "+memory +cpu +pids"
+)
+
+var rlimitResources = map[string]int{
+	"as":      syscall.RLIMIT_AS,
+	"core":    syscall.RLIMIT_CORE,
+	"cpu":     syscall.RLIMIT_CPU,
+	"data":    syscall.RLIMIT_DATA,
+	"fsize":   syscall.RLIMIT_FSIZE,
+	"nofile":  syscall.RLIMIT_NOFILE,
+	"nproc":   rlimitNproc,
+	"stack":   syscall.RLIMIT_STACK,
+	"memlock": rlimitMemlock,
+}
+
+// sandboxExec runs in the freshly forked shim, still with escarole's
+// credentials, and replaces itself with the app once the limits are in place
+// and it switched to the app uid/gid.
+func sandboxExec(encoded string, args []string) {
+	// Capability sets and no_new_privs are per-thread.
+	runtime.LockOSThread()
+
+	fail := func(f string, m ...interface{}) {
+		fmt.Fprintf(os.Stderr, "[escarole] [error] sandbox: "+f+"\n", m...)
+		os.Exit(126)
+	}
+
+	if len(args) < 1 {
+		fail("no command given")
+	}
+	sp, er := decodeSpec(encoded)
+	if er != nil {
+		fail("bad spec: %v", er)
+	}
+
+	for res, v := range sp.Rlimits {
+		if er := syscall.Setrlimit(res, &syscall.Rlimit{Cur: v[0], Max: v[1]}); er != nil {
+			fail("setrlimit(%d): %v", res, er)
+		}
+	}
+	if sp.Umask >= 0 {
+		syscall.Umask(sp.Umask)
+	}
+	if sp.DropCaps && os.Geteuid() == 0 {
+		if er := dropBoundingSet(); er != nil {
+			fail("drop capabilities: %v", er)
+		}
+	}
+	if er := switchUser(sp.UID, sp.GID); er != nil {
+		fail("switch to %d:%d: %v", sp.UID, sp.GID, er)
+	}
+	if sp.DropCaps {
+		if er := dropCapabilities(); er != nil {
+			fail("drop capabilities: %v", er)
+		}
+	}
+	if sp.NoNewPrivs {
+		if er := prctl(prSetNoNewPrivs, 1); er != nil {
+			fail("no_new_privs: %v", er)
+		}
+	}
+
+	if er := syscall.Exec(args[0], args, os.Environ()); er != nil {
+		fail("exec %s: %v", args[0], er)
+	}
+}
+
+// switchUser drops to uid and gid the way SysProcAttr.Credential would,
+// supplementary groups included. It is a no-op if they are already ours.
+func switchUser(uid, gid uint32) error {
+	if int(uid) == os.Getuid() && int(gid) == os.Getgid() {
+		return nil
+	}
+	if er := syscall.Setgroups(nil); er != nil {
+		return er
+	}
+	if er := syscall.Setgid(int(gid)); er != nil {
+		return er
+	}
+	return syscall.Setuid(int(uid))
+}
+
+// dropBoundingSet keeps the app from ever gaining capabilities, e.g. through
+// setuid binaries. It needs CAP_SETPCAP, so it runs before switchUser.
+func dropBoundingSet() error {
+	for c := 0; c <= capLast(); c++ {
+		if er := prctl(prCapbsetDrop, uintptr(c)); er != nil && er != syscall.EINVAL {
+			return er
+		}
+	}
+	return nil
+}
+
+// dropCapabilities clears the ambient, effective, permitted and inheritable
+// sets, which a uid 0 app would otherwise keep.
+func dropCapabilities() error {
+	if er := prctl(prCapAmbient, prCapAmbientClear); er != nil && er != syscall.EINVAL {
+		return er
+	}
+
+	hdr := struct {
+		version uint32
+		pid     int32
+	}{linuxCapVersion3, 0}
+	data := [2]struct{ effective, permitted, inheritable uint32 }{}
+	_, _, e := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+func capLast() int {
+	b, er := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if er != nil {
+		return defaultCapLast
+	}
+	n, er := strconv.Atoi(strings.TrimSpace(string(b)))
+	if er != nil {
+		return defaultCapLast
+	}
+	return n
+}
+
+func prctl(option int, arg uintptr) error {
+	_, _, e := syscall.RawSyscall(syscall.SYS_PRCTL, uintptr(option), arg, 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// setupCgroup creates a cgroup v2 sub-group for the app below escarole's own
+// (delegated) cgroup, applies the limits and has the app cloned into it.
+func setupCgroup(app *appProcess, name string, c *cgroupLimits) error {
+	base, er := ownCgroup()
+	if er != nil {
+		return er
+	}
+	if path.Base(base) == supervisorCgroup {
+		base = path.Dir(base)
+	}
+	dir := path.Join(cgroupRoot, base)
+
+	// cgroup v2 forbids processes in inner nodes, so move ourselves into a
+	// leaf before delegating controllers to the app group.
+	sup := path.Join(dir, supervisorCgroup)
+	if er := os.MkdirAll(sup, 0755); er != nil {
+		return er
+	}
+	if er := writeCgroup(sup, "cgroup.procs", strconv.Itoa(os.Getpid())); er != nil {
+		return er
+	}
+	if er := writeCgroup(dir, "cgroup.subtree_control", cgroupControllerSet); er != nil {
+		return er
+	}
+
+	grp := path.Join(dir, name)
+	if er := os.MkdirAll(grp, 0755); er != nil {
+		return er
+	}
+	if c.Memory > 0 {
+		if er := writeCgroup(grp, "memory.max", strconv.FormatInt(int64(c.Memory), 10)); er != nil {
+			return er
+		}
+	}
+	if c.CPU > 0 {
+		period := 100000
+		quota := int(c.CPU * float64(period))
+		if er := writeCgroup(grp, "cpu.max", fmt.Sprintf("%d %d", quota, period)); er != nil {
+			return er
+		}
+	}
+	if c.Pids > 0 {
+		if er := writeCgroup(grp, "pids.max", strconv.FormatInt(c.Pids, 10)); er != nil {
+			return er
+		}
+	}
+
+	app.cgroup = grp
+	logger.Infof("App cgroup: %s", grp)
+	return nil
+}
+
+// joinCgroup has the process started with attr cloned into the cgroup dir.
+// The returned func closes the cgroup fd once the process is started.
+func joinCgroup(attr *syscall.SysProcAttr, dir string) (func(), error) {
+	if dir == "" {
+		return func() {}, nil
+	}
+	fd, er := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if er != nil {
+		return nil, er
+	}
+	attr.UseCgroupFD = true
+	attr.CgroupFD = fd
+	return func() { syscall.Close(fd) }, nil
+}
+
+func ownCgroup() (string, error) {
+	f, er := os.Open("/proc/self/cgroup")
+	if er != nil {
+		return "", er
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if strings.HasPrefix(s.Text(), "0::") {
+			return strings.TrimPrefix(s.Text(), "0::"), nil
+		}
+	}
+	return "", fmt.Errorf("no cgroup v2 hierarchy found")
+}
+
+func writeCgroup(dir, file, val string) error {
+	return ioutil.WriteFile(path.Join(dir, file), []byte(val), 0644)
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+const sandboxSupported = false
+
+var rlimitResources = map[string]int{}
+
+func sandboxExec(encoded string, args []string) {
+	fmt.Fprintln(os.Stderr, "[escarole] [error] sandbox: not supported on this platform")
+	os.Exit(126)
+}
+
+func setupCgroup(app *appProcess, name string, c *cgroupLimits) error {
+	return errors.New("cgroups are only supported on linux")
+}
+
+func joinCgroup(attr *syscall.SysProcAttr, dir string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestRlimitUnmarshal(t *testing.T) {
+	tests := []struct {
+		in       string
+		cur, max uint64
+		err      string
+	}{
+		{`1024`, 1024, 1024, ""},
+		{`"1024"`, 1024, 1024, ""},
+		{`"512:1024"`, 512, 1024, ""},
+		{`"64KB"`, 64 << 10, 64 << 10, ""},
+		{`"1MB:unlimited"`, 1 << 20, math.MaxUint64, ""},
+		{`"infinity"`, math.MaxUint64, math.MaxUint64, ""},
+		{`" 8 : 16 "`, 8, 16, ""},
+		{`"2048:1024"`, 0, 0, "soft limit exceeds hard limit"},
+		{`"lots"`, 0, 0, `bad limit "lots"`},
+		{`"1:"`, 0, 0, `bad limit ""`},
+		{`-1`, 0, 0, `bad limit "-1"`},
+	}
+	for _, tt := range tests {
+		var r rlimit
+		er := json.Unmarshal([]byte(tt.in), &r)
+		switch {
+		case tt.err != "":
+			if er == nil || !strings.Contains(er.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.in, er, tt.err)
+			}
+		case er != nil:
+			t.Errorf("%s: %v", tt.in, er)
+		case r.Cur != tt.cur || r.Max != tt.max:
+			t.Errorf("%s: got %d:%d, want %d:%d", tt.in, r.Cur, r.Max, tt.cur, tt.max)
+		}
+	}
+}
+
+func TestByteSizeUnmarshal(t *testing.T) {
+	tests := []struct {
+		in   string
+		want byteSize
+		ok   bool
+	}{
+		{`1048576`, 1 << 20, true},
+		{`"512MB"`, 512 << 20, true},
+		{`"1GB"`, 1 << 30, true},
+		{`"10KiB"`, 10 << 10, true},
+		{`"12"`, 12, true},
+		{`"big"`, 0, false},
+	}
+	for _, tt := range tests {
+		var b byteSize
+		er := json.Unmarshal([]byte(tt.in), &b)
+		if (er == nil) != tt.ok || b != tt.want {
+			t.Errorf("%s: got %d, %v", tt.in, b, er)
+		}
+	}
+}
+
+func TestLimitsSpec(t *testing.T) {
+	if !sandboxSupported {
+		t.Skip("no sandbox on this platform")
+	}
+	l := &limits{Rlimits: map[string]rlimit{"NOFILE": {10, 20}, "nproc": {5, 5}}, NoNewPrivs: true}
+	sp, er := l.spec()
+	if er != nil {
+		t.Fatal(er)
+	}
+	if len(sp.Rlimits) != 2 || sp.Rlimits[rlimitResources["nofile"]] != [2]uint64{10, 20} || sp.Rlimits[rlimitNproc] != [2]uint64{5, 5} {
+		t.Errorf("got rlimits %v", sp.Rlimits)
+	}
+	if sp.Umask != -1 || !sp.NoNewPrivs || sp.DropCaps {
+		t.Errorf("got %+v", sp)
+	}
+
+	if sp, er := (&limits{Umask: "027"}).spec(); er != nil || sp.Umask != 027 {
+		t.Errorf("umask: got %+v, %v", sp, er)
+	}
+	if _, er := (&limits{Umask: "1777"}).spec(); er == nil {
+		t.Errorf("umask 1777: expected an error")
+	}
+
+	l = &limits{Rlimits: map[string]rlimit{"rss": {1, 1}}}
+	if _, er := l.spec(); er == nil || !strings.Contains(er.Error(), `unknown rlimit "rss"`) {
+		t.Errorf("unknown rlimit: got %v", er)
+	}
+}
+
+func TestLimitsWrap(t *testing.T) {
+	cmd := []string{"/bin/app", "-x"}
+	if got, er := (*limits)(nil).wrap(cmd); er != nil || len(got) != 2 {
+		t.Errorf("no limits: got %v, %v", got, er)
+	}
+	if got, er := (&limits{Cgroup: &cgroupLimits{Pids: 10}}).wrap(cmd); er != nil || len(got) != 2 {
+		t.Errorf("cgroup only: got %v, %v", got, er)
+	}
+	if !sandboxSupported {
+		return
+	}
+
+	l := &limits{Rlimits: map[string]rlimit{"core": {0, 0}}, DropCapabilities: true}
+	got, er := l.wrap(cmd)
+	if er != nil {
+		t.Fatal(er)
+	}
+	if len(got) != 5 || got[1] != sandboxCmd || got[3] != "/bin/app" || got[4] != "-x" {
+		t.Fatalf("got %v", got)
+	}
+	sp, er := decodeSpec(got[2])
+	if er != nil {
+		t.Fatal(er)
+	}
+	if !sp.DropCaps || len(sp.Rlimits) != 1 {
+		t.Errorf("decoded %+v", sp)
+	}
+}
+
+// TestSandboxShim has the shim set a hard limit and then drop to another
+// user. With CAP_SYS_RESOURCE the limit is raised, which only works in that
+// order.
+func TestSandboxShim(t *testing.T) {
+	if !sandboxSupported || os.Getuid() != 0 {
+		t.Skip("needs root and the sandbox")
+	}
+	if hasCapability(capSysResource) {
+		var orig syscall.Rlimit
+		if er := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &orig); er != nil {
+			t.Fatal(er)
+		}
+		if er := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &syscall.Rlimit{Cur: 256, Max: 512}); er != nil {
+			t.Fatal(er)
+		}
+		defer syscall.Setrlimit(syscall.RLIMIT_NOFILE, &orig)
+	}
+
+	sp := &sandboxSpec{
+		Rlimits:  map[int][2]uint64{syscall.RLIMIT_NOFILE: {256, 1024}},
+		Umask:    -1,
+		DropCaps: true,
+		UID:      65534,
+		GID:      65534,
+	}
+	b, er := json.Marshal(sp)
+	if er != nil {
+		t.Fatal(er)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSandboxHelper$", "--", "/bin/sh", "-c", "id -u; ulimit -Hn")
+	cmd.Env = append(os.Environ(), "ESCAROLE_TEST_SANDBOX="+base64.RawURLEncoding.EncodeToString(b))
+	out, er := cmd.CombinedOutput()
+	if er != nil {
+		t.Fatalf("%v: %s", er, out)
+	}
+	if got := strings.Fields(string(out)); len(got) != 2 || got[0] != "65534" || got[1] != "1024" {
+		t.Errorf("got %q, want uid 65534 and hard limit 1024", out)
+	}
+}
+
+// TestSandboxHelper is the shim TestSandboxShim runs.
+func TestSandboxHelper(t *testing.T) {
+	spec := os.Getenv("ESCAROLE_TEST_SANDBOX")
+	if spec == "" {
+		return
+	}
+	for i, a := range os.Args {
+		if a == "--" {
+			sandboxExec(spec, os.Args[i+1:])
+		}
+	}
+	t.Fatal("no command given")
+}
+
+const capSysResource = 24
+
+// hasCapability reports whether cap is in our effective set.
+func hasCapability(cap uint) bool {
+	b, er := os.ReadFile("/proc/self/status")
+	if er != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if v := strings.TrimPrefix(line, "CapEff:"); v != line {
+			set, er := strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+			return er == nil && set&(1<<cap) != 0
+		}
+	}
+	return false
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/albertrdixon/gearbox/logger"
+)
+
+const (
+	snapshotsDir  = "snapshots"
+	snapshotMeta  = "snapshot.json"
+	snapshotTar   = "data.tar.gz"
+	snapshotFiles = "data"
+	snapshotKeep  = 5
+)
+
+// snapshots copies app data aside while the app is down for an update, so a
+// rollback can put back data the new code migrated.
+type snapshots struct {
+	Paths  []string `json:"paths"`
+	Format string   `json:"format"`
+	Keep   int      `json:"keep"`
+}
+
+// snapshot is the data as it was when the app moved from one sha to another.
+// Missing paths did not exist yet and are removed on restore.
+type snapshot struct {
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Time    time.Time `json:"time"`
+	Format  string    `json:"format"`
+	Paths   []string  `json:"paths"`
+	Missing []string  `json:"missing,omitempty"`
+
+	dir string
+}
+
+func (s *snapshots) enabled() bool {
+	return s != nil && len(s.Paths) > 0
+}
+
+func (s *snapshots) format() string {
+	if s.Format == "" {
+		return "tar"
+	}
+	return s.Format
+}
+
+func (s *snapshots) validate() error {
+	if s == nil {
+		return nil
+	}
+	if len(s.Paths) < 1 {
+		return errors.New("no paths given")
+	}
+	for _, p := range s.Paths {
+		if !path.IsAbs(p) {
+			return fmt.Errorf("path %q is not absolute", p)
+		}
+	}
+	switch s.format() {
+	case "tar", "copy":
+		return nil
+	}
+	return fmt.Errorf("unknown format %q", s.Format)
+}
+
+// take snapshots the data paths before the app moves from one sha to another
+// and drops all but the newest keep snapshots.
+func (s *snapshots) take(from, to string) error {
+	if !s.enabled() {
+		return nil
+	}
+	now := time.Now()
+	snap := &snapshot{From: from, To: to, Time: now, Format: s.format()}
+	snap.dir = path.Join(stateDir(), snapshotsDir, now.Format("20060102-150405.000")+"-"+short(from))
+	if er := os.MkdirAll(snap.dir, 0700); er != nil {
+		return er
+	}
+
+	var er error
+	for _, p := range s.Paths {
+		if _, er := os.Lstat(p); os.IsNotExist(er) {
+			snap.Missing = append(snap.Missing, p)
+			continue
+		}
+		snap.Paths = append(snap.Paths, p)
+	}
+	if snap.Format == "tar" {
+		er = writeTar(path.Join(snap.dir, snapshotTar), snap.Paths)
+	} else {
+		for _, p := range snap.Paths {
+			if er = copyTree(p, path.Join(snap.dir, snapshotFiles, p)); er != nil {
+				break
+			}
+		}
+	}
+	if er == nil {
+		er = snap.save()
+	}
+	if er != nil {
+		os.RemoveAll(snap.dir)
+		return er
+	}
+	logEvent("info", "snapshot", "Snapshot of %s taken before moving from %s to %s", strings.Join(snap.Paths, ", "), short(from), short(to))
+
+	keep := s.Keep
+	if keep < 1 {
+		keep = snapshotKeep
+	}
+	all := listSnapshots()
+	for i := keep; i < len(all); i++ {
+		logger.Infof("Removing snapshot %s", path.Base(all[i].dir))
+		if er := os.RemoveAll(all[i].dir); er != nil {
+			logger.Warnf("Unable to remove %s: %v", all[i].dir, er)
+		}
+	}
+	return nil
+}
+
+// restore puts back the data from before the app moved from to, to cur, if
+// there is a snapshot of that.
+func (s *snapshots) restore(cur, to string) error {
+	if !s.enabled() {
+		return nil
+	}
+	var snap *snapshot
+	for _, sn := range listSnapshots() {
+		if sn.From == to && sn.To == cur {
+			snap = sn
+			break
+		}
+	}
+	if snap == nil {
+		logger.Warnf("No snapshot from %s to %s, leaving app data as is", short(to), short(cur))
+		return nil
+	}
+
+	// Restore into temp dirs next to the paths, so a failure leaves the live
+	// data alone, then swap them in.
+	stages := map[string]string{}
+	defer func() {
+		for _, st := range stages {
+			os.RemoveAll(st)
+		}
+	}()
+	for _, p := range snap.Paths {
+		if er := os.MkdirAll(path.Dir(p), 0755); er != nil {
+			return er
+		}
+		st, er := ioutil.TempDir(path.Dir(p), "."+path.Base(p)+".restore-")
+		if er != nil {
+			return er
+		}
+		stages[p] = st
+	}
+	if snap.Format == "tar" {
+		er := readTar(path.Join(snap.dir, snapshotTar), func(name string) string {
+			for p, st := range stages {
+				if name == p || strings.HasPrefix(name, p+"/") {
+					return path.Join(st, "new", strings.TrimPrefix(name, p))
+				}
+			}
+			return ""
+		})
+		if er != nil {
+			return er
+		}
+	} else {
+		for p, st := range stages {
+			if er := copyTree(path.Join(snap.dir, snapshotFiles, p), path.Join(st, "new")); er != nil {
+				return er
+			}
+		}
+	}
+
+	for _, p := range snap.Paths {
+		st := stages[p]
+		old := path.Join(st, "old")
+		if er := os.Rename(p, old); er != nil && !os.IsNotExist(er) {
+			return er
+		}
+		if er := os.Rename(path.Join(st, "new"), p); er != nil {
+			os.Rename(old, p)
+			return er
+		}
+	}
+	for _, p := range snap.Missing {
+		if er := os.RemoveAll(p); er != nil {
+			return er
+		}
+	}
+	logEvent("info", "snapshot_restored", "Restored %s from %s", strings.Join(snap.Paths, ", "), snap.Time.Format(time.Stamp))
+	return nil
+}
+
+func (sn *snapshot) save() error {
+	b, er := json.Marshal(sn)
+	if er != nil {
+		return er
+	}
+	return ioutil.WriteFile(path.Join(sn.dir, snapshotMeta), b, 0600)
+}
+
+// listSnapshots returns the snapshots newest first.
+func listSnapshots() []*snapshot {
+	root := path.Join(stateDir(), snapshotsDir)
+	list, er := ioutil.ReadDir(root)
+	if er != nil {
+		return nil
+	}
+	var all []*snapshot
+	for _, fi := range list {
+		dir := path.Join(root, fi.Name())
+		b, er := ioutil.ReadFile(path.Join(dir, snapshotMeta))
+		if er != nil {
+			continue
+		}
+		sn := &snapshot{dir: dir}
+		if er := json.Unmarshal(b, sn); er != nil {
+			logger.Warnf("Unable to read %s: %v", dir, er)
+			continue
+		}
+		all = append(all, sn)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Time.After(all[j].Time) })
+	return all
+}
+
+func writeTar(file string, paths []string) error {
+	f, er := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if er != nil {
+		return er
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	for _, p := range paths {
+		er := filepath.Walk(p, func(name string, fi os.FileInfo, er error) error {
+			if er != nil {
+				return er
+			}
+			link := ""
+			if fi.Mode()&os.ModeSymlink != 0 {
+				if link, er = os.Readlink(name); er != nil {
+					return er
+				}
+			}
+			hdr, er := tar.FileInfoHeader(fi, link)
+			if er != nil {
+				return er
+			}
+			hdr.Name = strings.TrimPrefix(name, "/")
+			if fi.IsDir() {
+				hdr.Name += "/"
+			}
+			if er := tw.WriteHeader(hdr); er != nil {
+				return er
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			src, er := os.Open(name)
+			if er != nil {
+				return er
+			}
+			defer src.Close()
+			_, er = io.Copy(tw, src)
+			return er
+		})
+		if er != nil {
+			return er
+		}
+	}
+	if er := tw.Close(); er != nil {
+		return er
+	}
+	if er := gz.Close(); er != nil {
+		return er
+	}
+	return f.Close()
+}
+
+// readTar extracts file, putting each entry where to says, skipping it if
+// that is "".
+func readTar(file string, to func(name string) string) error {
+	f, er := os.Open(file)
+	if er != nil {
+		return er
+	}
+	defer f.Close()
+	gz, er := gzip.NewReader(f)
+	if er != nil {
+		return er
+	}
+	tr := tar.NewReader(gz)
+
+	for {
+		hdr, er := tr.Next()
+		if er == io.EOF {
+			return nil
+		} else if er != nil {
+			return er
+		}
+		name := to(path.Join("/", hdr.Name))
+		if name == "" {
+			continue
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		if er := os.MkdirAll(path.Dir(name), 0755); er != nil {
+			return er
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if er := os.MkdirAll(name, mode); er != nil {
+				return er
+			}
+		case tar.TypeSymlink:
+			if er := os.Symlink(hdr.Linkname, name); er != nil {
+				return er
+			}
+		case tar.TypeReg:
+			dst, er := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+			if er != nil {
+				return er
+			}
+			_, er = io.Copy(dst, tr)
+			dst.Close()
+			if er != nil {
+				return er
+			}
+		default:
+			continue
+		}
+		if er := os.Lchown(name, hdr.Uid, hdr.Gid); er != nil {
+			return er
+		}
+		if hdr.Typeflag != tar.TypeSymlink {
+			os.Chmod(name, mode)
+			os.Chtimes(name, hdr.ModTime, hdr.ModTime)
+		}
+	}
+}
+
+// copyTree copies src to dst keeping modes, owners and times.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(name string, fi os.FileInfo, er error) error {
+		if er != nil {
+			return er
+		}
+		to := path.Join(dst, strings.TrimPrefix(name, src))
+		if er := os.MkdirAll(path.Dir(to), 0755); er != nil {
+			return er
+		}
+
+		switch {
+		case fi.IsDir():
+			if er := os.MkdirAll(to, fi.Mode().Perm()); er != nil {
+				return er
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			l, er := os.Readlink(name)
+			if er != nil {
+				return er
+			}
+			if er := os.Symlink(l, to); er != nil {
+				return er
+			}
+		case fi.Mode().IsRegular():
+			if er := copyFile(name, to, fi.Mode().Perm()); er != nil {
+				return er
+			}
+		default:
+			return nil
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			if er := os.Lchown(to, int(st.Uid), int(st.Gid)); er != nil {
+				return er
+			}
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			os.Chmod(to, fi.Mode().Perm())
+			os.Chtimes(to, fi.ModTime(), fi.ModTime())
+		}
+		return nil
+	})
+}
+
+// copyFile copies src to dst, as a reflink where the file system can. Unlike
+// a hard link that keeps dst apart from writes to src in place.
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, er := os.Open(src)
+	if er != nil {
+		return er
+	}
+	defer in.Close()
+	out, er := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if er != nil {
+		return er
+	}
+	if reflink(out, in) == nil {
+		return out.Close()
+	}
+	if _, er := io.Copy(out, in); er != nil {
+		out.Close()
+		return er
+	}
+	return out.Close()
+}
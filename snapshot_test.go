@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, format := range []string{"tar", "copy"} {
+		home, *name = t.TempDir(), "app"
+		data := t.TempDir()
+		db, extra := path.Join(data, "db"), path.Join(data, "new")
+		s := &snapshots{Paths: []string{db, extra}, Format: format}
+
+		if er := os.MkdirAll(path.Join(db, "sub"), 0750); er != nil {
+			t.Fatal(er)
+		}
+		os.WriteFile(path.Join(db, "data"), []byte("v1"), 0600)
+		os.WriteFile(path.Join(db, "sub", "x"), []byte("x"), 0644)
+		os.Symlink("data", path.Join(db, "link"))
+		if er := s.take("aaa", "bbb"); er != nil {
+			t.Fatalf("%s: take: %v", format, er)
+		}
+
+		// What the new version did to the data, writing in place.
+		os.WriteFile(path.Join(db, "data"), []byte("v2"), 0600)
+		os.WriteFile(path.Join(db, "added"), []byte("v2"), 0600)
+		os.WriteFile(extra, []byte("v2"), 0600)
+
+		if er := s.restore("bbb", "aaa"); er != nil {
+			t.Fatalf("%s: restore: %v", format, er)
+		}
+		if b, _ := os.ReadFile(path.Join(db, "data")); string(b) != "v1" {
+			t.Errorf("%s: data is %q", format, b)
+		}
+		if l, _ := os.Readlink(path.Join(db, "link")); l != "data" {
+			t.Errorf("%s: link is %q", format, l)
+		}
+		if fi, er := os.Stat(path.Join(db, "sub")); er != nil || fi.Mode().Perm() != 0750 {
+			t.Errorf("%s: sub is %v, %v", format, fi, er)
+		}
+		for _, f := range []string{path.Join(db, "added"), extra} {
+			if _, er := os.Lstat(f); !os.IsNotExist(er) {
+				t.Errorf("%s: %s still there", format, f)
+			}
+		}
+		if list, _ := os.ReadDir(data); len(list) != 1 {
+			t.Errorf("%s: left %d entries next to the data", format, len(list))
+		}
+	}
+}
+
+func TestSnapshotRestoreFailure(t *testing.T) {
+	home, *name = t.TempDir(), "app"
+	db := path.Join(t.TempDir(), "db")
+	s := &snapshots{Paths: []string{db}}
+	os.WriteFile(db, []byte("v1"), 0600)
+	if er := s.take("aaa", "bbb"); er != nil {
+		t.Fatal(er)
+	}
+	os.WriteFile(db, []byte("v2"), 0600)
+
+	// A broken snapshot must leave the live data alone.
+	snap := listSnapshots()[0]
+	os.WriteFile(path.Join(snap.dir, snapshotTar), []byte("garbage"), 0600)
+	if er := s.restore("bbb", "aaa"); er == nil {
+		t.Errorf("expected an error")
+	}
+	if b, _ := os.ReadFile(db); string(b) != "v2" {
+		t.Errorf("data is %q", b)
+	}
+	if list, _ := os.ReadDir(path.Dir(db)); len(list) != 1 {
+		t.Errorf("left %d entries next to the data", len(list))
+	}
+}
+
+func TestSnapshotFailureAborts(t *testing.T) {
+	base := testRepo(t)
+	setSHA(base)
+	data := t.TempDir()
+	l, er := net.Listen("unix", path.Join(data, "sock"))
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer l.Close()
+	cfg = &command{Snapshots: &snapshots{Paths: []string{data}}}
+	s, log := testSupervisor(t)
+	head := commitFile(t, "a", "new")
+
+	// A socket cannot be archived, so the update must not go through.
+	if ok, er := s.finish(head, nil); ok || er == nil {
+		t.Fatalf("got %v, %v", ok, er)
+	}
+	if at := mustGit(t, "rev-parse", "HEAD"); sha != base || at != base {
+		t.Errorf("at %s, checkout at %s, want %s", sha, at, base)
+	}
+	step(t, s)
+	if shas := startedOn(t, log, 2); shas[1] != base {
+		t.Errorf("started on %v, want %s", shas, base)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/albertrdixon/gearbox/logger"
+)
+
+const seenFile = "seen.json"
+
+// soaked returns the newest upstream commit between sha and up that is older
+// than --min-commit-age, sha if none is yet. A commit's age counts from the
+// later of its committer date and the first time escarole saw it upstream.
+func soaked(up string) (string, error) {
+	if *minAge <= 0 || up == sha {
+		return up, nil
+	}
+	out, er := gitOutput("log", "--first-parent", "--format=%H %ct", sha+".."+up)
+	if er != nil {
+		return "", er
+	}
+
+	var (
+		now    = time.Now()
+		seen   = loadSeen()
+		next   = make(map[string]time.Time)
+		target string
+		newer  int
+	)
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			continue
+		}
+		ct, er := strconv.ParseInt(f[1], 10, 64)
+		if er != nil {
+			return "", er
+		}
+		at, ok := seen[f[0]]
+		if !ok {
+			at = now
+		}
+		next[f[0]] = at
+
+		if target != "" {
+			continue
+		}
+		if c := time.Unix(ct, 0); c.After(at) {
+			at = c
+		}
+		if now.Sub(at) >= *minAge {
+			target = f[0]
+			continue
+		}
+		newer++
+	}
+	if er := saveSeen(next); er != nil {
+		logger.Warnf("Unable to save first seen times: %v", er)
+	}
+
+	if target == "" {
+		logger.Infof("Upstream is at %s, no commit older than %v yet", short(up), *minAge)
+		return sha, nil
+	}
+	if newer > 0 {
+		logger.Infof("Holding back %d commits newer than %v", newer, *minAge)
+	}
+	return target, nil
+}
+
+// loadSeen returns when pending upstream commits were first seen.
+func loadSeen() map[string]time.Time {
+	seen := make(map[string]time.Time)
+	b, er := ioutil.ReadFile(path.Join(stateDir(), seenFile))
+	if er != nil {
+		return seen
+	}
+	if er := json.Unmarshal(b, &seen); er != nil {
+		logger.Warnf("Unable to read %s: %v", seenFile, er)
+	}
+	return seen
+}
+
+func saveSeen(seen map[string]time.Time) error {
+	dir := stateDir()
+	if er := os.MkdirAll(dir, 0755); er != nil {
+		return er
+	}
+	b, er := json.Marshal(seen)
+	if er != nil {
+		return er
+	}
+	return ioutil.WriteFile(path.Join(dir, seenFile), b, 0644)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSoaked(t *testing.T) {
+	base := testRepo(t)
+	sha = base
+	old := time.Now().Add(-2 * time.Hour)
+	date := fmt.Sprintf("GIT_COMMITTER_DATE=%d +0000", old.Unix())
+	first := commitFile(t, "a", "old", date)
+	second := commitFile(t, "b", "new")
+
+	*minAge = 0
+	if got, er := soaked(second); er != nil || got != second {
+		t.Errorf("no min age: got %s, %v", got, er)
+	}
+
+	// Both commits are seen for the first time now, so none is old enough
+	// however old its committer date.
+	*minAge = time.Hour
+	defer func() { *minAge = 0 }()
+	if got, er := soaked(second); er != nil || got != base {
+		t.Errorf("first seen: got %s, %v, want %s", got, er, base)
+	}
+	seen := loadSeen()
+	if len(seen) != 2 || seen[first].IsZero() || seen[second].IsZero() {
+		t.Fatalf("seen %v", seen)
+	}
+
+	// Seen an hour and more ago, only the old commit counts as soaked.
+	seen[first], seen[second] = old, old
+	if er := saveSeen(seen); er != nil {
+		t.Fatal(er)
+	}
+	if got, er := soaked(second); er != nil || got != first {
+		t.Errorf("soaked: got %s, %v, want %s", got, er, first)
+	}
+	if got, er := soaked(base); er != nil || got != base {
+		t.Errorf("up to date: got %s, %v", got, er)
+	}
+}
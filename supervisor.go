@@ -0,0 +1,461 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/albertrdixon/gearbox/logger"
+	"golang.org/x/net/context"
+)
+
+// supervisor owns the app process. Everything that starts, stops or moves it
+// or reads its state runs in its loop, control requests included.
+type supervisor struct {
+	app      *appProcess
+	c        context.Context
+	failures int
+	crashes  []time.Time
+	stopped  bool
+	deferred *deferral
+	status   appStatus
+
+	// relaunch fires when the app is due to be started again: a while after
+	// it failed to start, or right away after it was moved while down.
+	relaunch <-chan time.Time
+}
+
+// relaunchDelay is how long to wait before starting an app again that
+// failed to start.
+const relaunchDelay = 2 * time.Minute
+
+type appStatus struct {
+	Version     string     `json:"version"`
+	App         string     `json:"app"`
+	Project     string     `json:"project"`
+	Ref         string     `json:"ref"`
+	SHA         string     `json:"sha"`
+	Previous    string     `json:"previous_sha,omitempty"`
+	PID         int        `json:"pid"`
+	Started     time.Time  `json:"started"`
+	Restarts    int        `json:"restarts"`
+	Reloads     int        `json:"reloads"`
+	LastCheck   *time.Time `json:"last_check,omitempty"`
+	LastUpdate  *time.Time `json:"last_update,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	NextCheck   time.Time  `json:"next_check"`
+	Skipped     string     `json:"skipped_sha,omitempty"`
+	Rejected    string     `json:"rejected_sha,omitempty"`
+	Pinned      string     `json:"pinned,omitempty"`
+	Paused      bool       `json:"paused"`
+	Pending     *pending   `json:"pending,omitempty"`
+	Approved    *approval  `json:"approved,omitempty"`
+	Deferred    *deferral  `json:"deferred,omitempty"`
+	ConfigFile  string     `json:"config"`
+	UpdateEvery string     `json:"update_interval"`
+}
+
+func run(app *appProcess, c context.Context, cancel context.CancelFunc) {
+	s := &supervisor{app: app, c: c}
+	s.loop()
+	cancel()
+}
+
+func (s *supervisor) loop() {
+	up := time.NewTicker(*interval)
+	s.status.NextCheck = time.Now().Add(*interval)
+
+	if er := execute(s.app, s.c); er != nil {
+		logEvent("error", "start_failed", "%v failed to execute: %v", s.app, er)
+		return
+	}
+	s.started()
+
+	for s.failures < 10 {
+		select {
+		case <-s.c.Done():
+			return
+		case <-s.exits():
+			s.exited()
+		case <-s.relaunch:
+			s.relaunch = nil
+			s.start()
+		case <-reload:
+			s.reload()
+		case <-s.retry():
+			s.apply(s.deferred.SHA, s.deferred.files)
+		case t := <-up.C:
+			s.status.NextCheck = t.Add(*interval)
+			if why := holdReason(); why != "" {
+				logger.Infof("Not updating %v, %s", *name, why)
+				continue
+			}
+			logEvent("info", "update_check", "Updating %v at %v", *name, t.Format(time.Stamp))
+			s.update()
+		case req := <-control:
+			req.reply <- s.handle(req)
+		}
+	}
+}
+
+func (s *supervisor) started() {
+	logEvent("info", "app_started", "Started %v", s.app)
+	s.status.PID = s.app.Pid()
+	s.status.Started = time.Now()
+}
+
+func (s *supervisor) exited() {
+	if !s.stopped {
+		logEvent("warn", eventAppExited, "%v exited", s.app)
+		notify(eventAppExited, "", "", nil, nil)
+		if s.crashes = crashLoop(append(s.crashes, time.Now())); len(s.crashes) >= crashLoopCount {
+			logEvent("error", eventCrashLoop, "%v exited %d times in %v", s.app, len(s.crashes), crashLoopWindow)
+			notify(eventCrashLoop, "", "", nil, nil)
+			s.crashes = nil
+		}
+	}
+	s.stopped = false
+	s.status.Restarts++
+	if d := s.deferred; d != nil {
+		// The app is down anyway, move it to the deferred sha. Unless that
+		// failed early, the loop starts it once the move is recorded.
+		logEvent("info", "restart", "Applying deferred update of %v to %s, the app exited", s.app, short(d.SHA))
+		s.deferred = nil
+		if s.finish(d.SHA, d.files); s.relaunch != nil {
+			return
+		}
+	}
+	s.start()
+}
+
+// start starts the app, or has the loop try again in a while if it fails.
+func (s *supervisor) start() {
+	if er := execute(s.app, s.c); er != nil {
+		logEvent("error", "start_failed", "%v failed to execute, retrying in %v: %v", s.app, relaunchDelay, er)
+		s.failures++
+		s.status.PID = 0
+		s.relaunch = time.After(relaunchDelay)
+		return
+	}
+	s.started()
+}
+
+// running tells whether the app is up, not exited or waiting to be started
+// again.
+func (s *supervisor) running() bool {
+	if s.relaunch != nil {
+		return false
+	}
+	select {
+	case <-s.app.Exited():
+		return false
+	default:
+		return true
+	}
+}
+
+// exits is the app's exit channel, none while it waits to be started again.
+func (s *supervisor) exits() <-chan struct{} {
+	if s.relaunch != nil {
+		return nil
+	}
+	return s.app.Exited()
+}
+
+func (s *supervisor) reload() {
+	logger.Infof("Reloading config %q", *conf)
+	next, er := reloadApp(s.c)
+	if er != nil {
+		logger.Errorf("Failed reload: %v", er)
+		return
+	}
+	if next == nil {
+		logger.Infof("Config unchanged, not restarting %v", s.app)
+		return
+	}
+	logEvent("info", "restart", "Config changed, restarting %v", s.app)
+	if er := stop(s.app, s.c); er != nil {
+		logger.Errorf("Failed to kill %v: %v", s.app, er)
+		s.failures++
+		return
+	}
+	s.app = next
+	s.start()
+}
+
+// update fetches and, if upstream moved, restarts the app on the new sha.
+func (s *supervisor) update() (bool, error) {
+	now := time.Now()
+	s.status.LastCheck = &now
+	var checked string
+	if s.deferred != nil {
+		checked = s.deferred.SHA
+	}
+	head, updated, er := update(s.c, checked)
+	if u, ok := er.(*unverified); ok {
+		logEvent("error", eventUpdateRefused, "Not updating %v: %v", s.app, er)
+		commits, _ := commitRange(sha, u.sha)
+		notify(eventUpdateRefused, sha, u.sha, commits, er)
+		s.status.LastError = er.Error()
+		return false, er
+	}
+	if er != nil {
+		logEvent("error", eventUpdateFailed, "Failed update: %v", er)
+		notify(eventUpdateFailed, sha, "", nil, er)
+		s.status.LastError = er.Error()
+		return false, er
+	}
+	if !updated {
+		return false, nil
+	}
+
+	files, er := changedFiles(sha, head)
+	if er != nil {
+		logger.Warnf("Unable to list changed files, running every rule and restarting: %v", er)
+	}
+	if !cfg.Restart.needed(files) {
+		logEvent("info", "update_no_restart", "Updated %v to %s, no restart needed", s.app, short(head))
+		notify(eventUpdateApplied, sha, head, deploy("update", sha, head), nil)
+		setSHA(head)
+		s.status.LastUpdate = &now
+		return true, nil
+	}
+
+	return s.apply(head, files)
+}
+
+// apply restarts the app on head, which update checked out, unless the app
+// is busy. Then the restart is deferred and tried again until the app is idle
+// or busy.max_wait passed.
+func (s *supervisor) apply(head string, files []string) (bool, error) {
+	since, again := time.Now(), s.deferred != nil
+	if again {
+		since = s.deferred.Since
+	}
+	s.deferred = nil
+
+	if why := cfg.Busy.busy(s.c); why != "" {
+		until := since.Add(cfg.Busy.maxWait())
+		if time.Now().Before(until) {
+			if again {
+				logger.Debugf("%v still busy: %s", s.app, why)
+			} else {
+				logEvent("info", "restart_deferred", "Deferring restart of %v on %s, app is busy: %s", s.app, short(head), why)
+			}
+			s.deferred = &deferral{
+				SHA:   head,
+				Since: since,
+				Until: until,
+				files: files,
+				retry: time.After(cfg.Busy.interval()),
+			}
+			return false, nil
+		}
+		logEvent("warn", "restart_forced", "%v still busy after %v, restarting anyway: %s", s.app, cfg.Busy.maxWait(), why)
+	}
+	return s.finish(head, files)
+}
+
+// finish installs head and restarts the app on it.
+func (s *supervisor) finish(head string, files []string) (bool, error) {
+	if er := install(s.c, files, head); er != nil {
+		logEvent("error", eventUpdateFailed, "Not restarting %v: %v", s.app, er)
+		notify(eventUpdateFailed, sha, head, nil, er)
+		s.status.LastError = er.Error()
+		return false, er
+	}
+
+	if er := s.refresh(head, snapshotting("update", head)); er != nil {
+		s.abort(head, er)
+		notify(eventUpdateFailed, sha, head, nil, er)
+		return false, er
+	}
+	notify(eventUpdateApplied, sha, head, deploy("update", sha, head), nil)
+	setSHA(head)
+	now := time.Now()
+	s.status.LastUpdate = &now
+	return true, nil
+}
+
+// retry fires when a deferred restart is due to be tried again.
+func (s *supervisor) retry() <-chan time.Time {
+	if s.deferred == nil {
+		return nil
+	}
+	return s.deferred.retry
+}
+
+// restart stops the app, the loop starts it again once it exited.
+func (s *supervisor) restart() error {
+	return s.restartWith(nil)
+}
+
+// restartWith restarts the app and runs down, if given, while it is stopped.
+// The loop starts the app again, after the caller recorded the move. If down
+// fails a *downFailed is returned.
+func (s *supervisor) restartWith(down func() error) error {
+	if !s.running() {
+		// Nothing to stop, so have it started right away instead of waiting.
+		s.relaunch = time.After(0)
+		if down != nil {
+			if er := down(); er != nil {
+				return &downFailed{er}
+			}
+		}
+		return nil
+	}
+	if er := stop(s.app, s.c); er != nil {
+		logger.Errorf("Failed to kill %v: %v", s.app, er)
+		s.failures++
+		s.status.LastError = er.Error()
+		return er
+	}
+	s.stopped = true
+	if down != nil {
+		if er := down(); er != nil {
+			return &downFailed{er}
+		}
+	}
+	return nil
+}
+
+// downFailed is an error of what had to be done while the app was stopped.
+type downFailed struct {
+	error
+}
+
+// abort moves the checkout back from head to the running sha when er, from
+// moving to head, means the app must not start on head. The loop starts the
+// app again as restartWith arranged.
+func (s *supervisor) abort(head string, er error) {
+	if _, ok := er.(*downFailed); !ok {
+		return
+	}
+	logEvent("error", eventUpdateFailed, "Not moving %v to %s, staying at %s: %v", s.app, short(head), short(sha), er)
+	s.status.LastError = er.Error()
+	if _, er := gitOutput("reset", "--hard", sha); er != nil {
+		logger.Errorf("Unable to check out %s again: %v", short(sha), er)
+		return
+	}
+	if cfg.Clone.submodules() {
+		if er := cfg.Clone.updateSubmodules(); er != nil {
+			logger.Errorf("Unable to update submodules: %v", er)
+		}
+	}
+	files, _ := changedFiles(head, sha)
+	if er := install(s.c, files, sha); er != nil {
+		logger.Errorf("Unable to install %s again: %v", short(sha), er)
+	}
+}
+
+// snapshotting returns what to do with app data while the app is down for
+// moving from sha to full: put it back as it was at full on rollback, else
+// take a snapshot. Without a snapshot the move is aborted, a failed restore
+// leaves the data as it is. nil without snapshots.
+func snapshotting(reason, full string) func() error {
+	if !cfg.Snapshots.enabled() {
+		return nil
+	}
+	from := sha
+	return func() error {
+		if reason == "rollback" {
+			if er := cfg.Snapshots.restore(from, full); er != nil {
+				logEvent("error", "snapshot_failed", "Unable to restore app data: %v", er)
+			}
+			return nil
+		}
+		if er := cfg.Snapshots.take(from, full); er != nil {
+			logEvent("error", "snapshot_failed", "Unable to snapshot app data: %v", er)
+			return fmt.Errorf("snapshot: %v", er)
+		}
+		return nil
+	}
+}
+
+// rollback moves the checkout back to target, the previous sha by default,
+// and keeps updates from moving forward to the sha rolled back from.
+func (s *supervisor) rollback(target string) error {
+	if p := pinned(); p != "" {
+		return fmt.Errorf("pinned to %s, unpin first", p)
+	}
+	if target == "" {
+		target = previous
+	}
+	if target == "" {
+		return errors.New("no previous sha to roll back to")
+	}
+	full, er := resolve(target)
+	if er != nil {
+		return er
+	}
+	if full == sha {
+		return fmt.Errorf("already at %s", short(full))
+	}
+
+	logEvent("warn", eventRollback, "Rolling back %v from %s to %s", s.app, short(sha), short(full))
+	from := sha
+	if er := s.moveTo("rollback", full); er != nil {
+		return er
+	}
+	notify(eventRollback, from, full, nil, nil)
+	held.Skipped = from
+	saveHold()
+	return nil
+}
+
+// moveTo checks out full and restarts the app on it.
+func (s *supervisor) moveTo(reason, full string) error {
+	s.deferred = nil
+	if _, er := gitOutput("reset", "--hard", full); er != nil {
+		return er
+	}
+	if cfg.Clone.submodules() {
+		if er := cfg.Clone.updateSubmodules(); er != nil {
+			return er
+		}
+	}
+	files, er := changedFiles(sha, full)
+	if er != nil {
+		logger.Warnf("Unable to list changed files, running every rule: %v", er)
+	}
+	if er := install(s.c, files, full); er != nil {
+		return er
+	}
+	if er := s.refresh(full, snapshotting(reason, full)); er != nil {
+		s.abort(full, er)
+		return er
+	}
+	deploy(reason, sha, full)
+	setSHA(full)
+	return nil
+}
+
+// snapshot returns the current status.
+func (s *supervisor) snapshot() appStatus {
+	st := s.status
+	st.Version = version
+	st.App = *name
+	st.Project = *project
+	st.Ref = ref
+	st.SHA = sha
+	st.Previous = previous
+	st.Skipped = held.Skipped
+	st.Rejected = rejected
+	st.Pinned = pinned()
+	st.Paused = held.Paused
+	st.Pending = held.Pending
+	st.Approved = held.Approved
+	st.Deferred = s.deferred
+	st.ConfigFile = *conf
+	st.UpdateEvery = interval.String()
+	return st
+}
+
+// crashLoop drops exits that fell out of the crash loop window.
+func crashLoop(exits []time.Time) []time.Time {
+	cut := time.Now().Add(-crashLoopWindow)
+	for len(exits) > 0 && exits[0].Before(cut) {
+		exits = exits[1:]
+	}
+	return exits
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// testSupervisor starts an app on the repo testRepo made that logs the
+// APP_SHA it was started with, and returns its supervisor and the log.
+func testSupervisor(t *testing.T) (*supervisor, string) {
+	t.Helper()
+	log := path.Join(t.TempDir(), "started")
+	app, er := newAppProcess(*name, []string{"sh", "-c", "echo $APP_SHA >> " + log + "; exec sleep 60"}, ioutil.Discard)
+	if er != nil {
+		t.Fatal(er)
+	}
+	app.SetDir(path.Join(home, *name))
+
+	c, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := &supervisor{app: app, c: c}
+	if er := execute(app, c); er != nil {
+		t.Fatal(er)
+	}
+	s.started()
+	startedOn(t, log, 1)
+	return s, log
+}
+
+// step does what the loop does for the next exit, relaunch or retry.
+func step(t *testing.T, s *supervisor) {
+	t.Helper()
+	select {
+	case <-s.exits():
+		s.exited()
+	case <-s.relaunch:
+		s.relaunch = nil
+		s.start()
+	case <-s.retry():
+		s.apply(s.deferred.SHA, s.deferred.files)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the loop had nothing to do")
+	}
+}
+
+// startedOn waits for the app to have started n times and returns the shas
+// it started on.
+func startedOn(t *testing.T, log string, n int) []string {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		b, _ := ioutil.ReadFile(log)
+		if shas := strings.Fields(string(b)); len(shas) >= n {
+			return shas
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("app did not start %d times", n)
+	return nil
+}
+
+// stopApp kills the app and waits for it to be gone.
+func stopApp(t *testing.T, s *supervisor) {
+	t.Helper()
+	s.app.Process.Kill()
+	<-s.app.Exited()
+}
+
+func TestRelaunch(t *testing.T) {
+	base := testRepo(t)
+	setSHA(base)
+	cfg = new(command)
+	s, log := testSupervisor(t)
+
+	// An app waiting to be started again is started right away on a restart.
+	stopApp(t, s)
+	s.relaunch = time.After(time.Hour)
+	if er := s.restart(); er != nil {
+		t.Fatal(er)
+	}
+	step(t, s)
+	if shas := startedOn(t, log, 2); shas[1] != base {
+		t.Errorf("started on %v", shas)
+	}
+}
+
+func TestMoveWhileDown(t *testing.T) {
+	base := testRepo(t)
+	setSHA(base)
+	cfg = new(command)
+	s, log := testSupervisor(t)
+	head := commitFile(t, "a", "new")
+
+	// The move is recorded before the app starts on it.
+	stopApp(t, s)
+	s.relaunch = time.After(time.Hour)
+	if ok, er := s.finish(head, nil); !ok || er != nil {
+		t.Fatalf("finish: %v", er)
+	}
+	if sha != head || lastDeployed() != head {
+		t.Errorf("at %s, deployed %s", sha, lastDeployed())
+	}
+	step(t, s)
+	if shas := startedOn(t, log, 2); shas[1] != head {
+		t.Errorf("started on %v, want %s", shas, head)
+	}
+}
+
+func TestFinishRestarts(t *testing.T) {
+	base := testRepo(t)
+	setSHA(base)
+	cfg = new(command)
+	s, log := testSupervisor(t)
+	head := commitFile(t, "a", "new")
+
+	if ok, er := s.finish(head, nil); !ok || er != nil {
+		t.Fatalf("finish: %v", er)
+	}
+	step(t, s)
+	if shas := startedOn(t, log, 2); shas[1] != head {
+		t.Errorf("started on %v, want %s", shas, head)
+	}
+	if s.status.PID == 0 || previous != base {
+		t.Errorf("pid %d, previous %s", s.status.PID, previous)
+	}
+}
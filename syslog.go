@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	syslogFacility = 3 // daemon
+	journalSocket  = "/run/systemd/journal/socket"
+)
+
+// syslogWriter sends RFC 5424 messages over a unix, udp or tcp socket.
+type syslogWriter struct {
+	network, addr string
+	host          string
+	conn          net.Conn
+}
+
+// journalWriter speaks journald's native protocol.
+type journalWriter struct {
+	conn net.Conn
+}
+
+// dialSyslog connects to addr, e.g. unix:///dev/log, udp://host:514 or
+// tcp://host:601.
+func dialSyslog(addr string) (*syslogWriter, error) {
+	u, er := url.Parse(addr)
+	if er != nil {
+		return nil, er
+	}
+	s := &syslogWriter{network: u.Scheme, addr: u.Host}
+	switch u.Scheme {
+	case "unix":
+		s.addr = u.Path
+	case "udp", "tcp":
+	default:
+		return nil, fmt.Errorf("unsupported syslog address %q", addr)
+	}
+	if s.host, er = os.Hostname(); er != nil {
+		s.host = "-"
+	}
+	return s, s.connect()
+}
+
+func (s *syslogWriter) connect() error {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	if s.network == "unix" {
+		c, er := net.Dial("unixgram", s.addr)
+		if er != nil {
+			if c, er = net.Dial("unix", s.addr); er != nil {
+				return er
+			}
+		}
+		s.conn = c
+		return nil
+	}
+	c, er := net.DialTimeout(s.network, s.addr, 5*time.Second)
+	if er != nil {
+		return er
+	}
+	s.conn = c
+	return nil
+}
+
+func (s *syslogWriter) writeRecord(rec record) error {
+	ident, pid := "escarole", os.Getpid()
+	if rec.fromApp() {
+		ident = rec.str("app")
+		if p, ok := rec["pid"].(int); ok && p > 0 {
+			pid = p
+		}
+	}
+	msgid := rec.str("event")
+	if msgid == "" {
+		msgid = rec.str("stream")
+	}
+	if msgid == "" {
+		msgid = "-"
+	}
+
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		syslogFacility*8+rec.severity(),
+		time.Now().Format(time.RFC3339Nano),
+		s.host, ident, pid, msgid, rec.message())
+
+	if s.conn != nil {
+		if _, er := s.conn.Write(s.frame(msg)); er == nil {
+			return nil
+		}
+	}
+	if er := s.connect(); er != nil {
+		return er
+	}
+	_, er := s.conn.Write(s.frame(msg))
+	return er
+}
+
+// frame prefixes msg with its length (RFC 6587 octet counting) on stream
+// sockets, tcp or a unix socket that does not take datagrams, where nothing
+// else tells where a message ends.
+func (s *syslogWriter) frame(msg string) []byte {
+	switch s.conn.RemoteAddr().Network() {
+	case "tcp", "unix":
+		return []byte(fmt.Sprintf("%d %s", len(msg), msg))
+	}
+	return []byte(msg)
+}
+
+func dialJournal() (*journalWriter, error) {
+	c, er := net.Dial("unixgram", journalSocket)
+	if er != nil {
+		return nil, er
+	}
+	return &journalWriter{conn: c}, nil
+}
+
+func (j *journalWriter) writeRecord(rec record) error {
+	ident := "escarole"
+	if rec.fromApp() {
+		ident = rec.str("app")
+	}
+
+	b := new(bytes.Buffer)
+	journalField(b, "MESSAGE", rec.message())
+	journalField(b, "PRIORITY", fmt.Sprint(rec.severity()))
+	journalField(b, "SYSLOG_IDENTIFIER", ident)
+	journalField(b, "ESCAROLE_APP", rec.str("app"))
+	for _, k := range []string{"sha", "event", "stream", "pid"} {
+		if v := rec.str(k); v != "" {
+			journalField(b, "ESCAROLE_"+strings.ToUpper(k), v)
+		}
+	}
+	_, er := j.conn.Write(b.Bytes())
+	return er
+}
+
+// journalField encodes one field, using the length-prefixed form for values
+// containing newlines.
+func journalField(b *bytes.Buffer, k, v string) {
+	if !strings.Contains(v, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", k, v)
+		return
+	}
+	b.WriteString(k + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(v)))
+	b.WriteString(v + "\n")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readFramed reads one octet counted message.
+func readFramed(t *testing.T, r *bufio.Reader) string {
+	n, er := r.ReadString(' ')
+	if er != nil {
+		t.Fatal(er)
+	}
+	size, er := strconv.Atoi(strings.TrimSpace(n))
+	if er != nil {
+		t.Fatalf("no octet count: %q", n)
+	}
+	b := make([]byte, size)
+	if _, er := io.ReadFull(r, b); er != nil {
+		t.Fatal(er)
+	}
+	return string(b)
+}
+
+func TestSyslogStreamFraming(t *testing.T) {
+	sock := path.Join(t.TempDir(), "log")
+	for _, addr := range []string{"unix://" + sock, "tcp://127.0.0.1:0"} {
+		u := strings.SplitN(addr, "://", 2)
+		l, er := net.Listen(u[0], u[1])
+		if er != nil {
+			t.Fatal(er)
+		}
+		defer l.Close()
+		if u[0] == "tcp" {
+			addr = "tcp://" + l.Addr().String()
+		}
+
+		s, er := dialSyslog(addr)
+		if er != nil {
+			t.Fatal(er)
+		}
+		c, er := l.Accept()
+		if er != nil {
+			t.Fatal(er)
+		}
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(c)
+
+		for _, m := range []string{"first", "second\nline"} {
+			if er := s.writeRecord(record{"level": "warn", "msg": m}); er != nil {
+				t.Fatal(er)
+			}
+		}
+		for _, m := range []string{"first", "second\nline"} {
+			got := readFramed(t, r)
+			if !strings.HasPrefix(got, fmt.Sprintf("<%d>1 ", syslogFacility*8+4)) || !strings.HasSuffix(got, " - "+m) {
+				t.Errorf("%s: got %q", addr, got)
+			}
+		}
+		c.Close()
+	}
+}
+
+func TestSyslogDatagrams(t *testing.T) {
+	sock := path.Join(t.TempDir(), "log")
+	c, er := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer c.Close()
+
+	s, er := dialSyslog("unix://" + sock)
+	if er != nil {
+		t.Fatal(er)
+	}
+	if er := s.writeRecord(record{"level": "info", "msg": "hello"}); er != nil {
+		t.Fatal(er)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1024)
+	n, er := c.Read(b)
+	if er != nil {
+		t.Fatal(er)
+	}
+	if got := string(b[:n]); !strings.HasPrefix(got, fmt.Sprintf("<%d>1 ", syslogFacility*8+6)) || !strings.HasSuffix(got, " - hello") {
+		t.Errorf("got %q", got)
+	}
+}
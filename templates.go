@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/albertrdixon/gearbox/logger"
+)
+
+type configTemplate struct {
+	Src   string    `json:"src"`
+	Dest  string    `json:"dest"`
+	Owner string    `json:"owner"`
+	Mode  *fileMode `json:"mode"`
+}
+
+// templateData is what templates are rendered with.
+type templateData struct {
+	Env map[string]string
+	App struct {
+		Name, Home, Project, Branch, SHA, Ref string
+	}
+}
+
+// templateFuncs are the helpers besides env, which reads the app env.
+var templateFuncs = template.FuncMap{
+	"default": func(def string, v ...string) string {
+		if len(v) > 0 && v[0] != "" {
+			return v[0]
+		}
+		return def
+	},
+	"required": func(k, v string) (string, error) {
+		if v == "" {
+			return "", fmt.Errorf("%s is required", k)
+		}
+		return v, nil
+	},
+	"file": func(f string) (string, error) {
+		b, er := ioutil.ReadFile(f)
+		return strings.TrimRight(string(b), "\r\n"), er
+	},
+	"json": func(v interface{}) (string, error) {
+		b, er := json.Marshal(v)
+		return string(b), er
+	},
+	"bool": func(s string) bool {
+		b, _ := strconv.ParseBool(s)
+		return b
+	},
+	"lower":     strings.ToLower,
+	"upper":     strings.ToUpper,
+	"trim":      strings.TrimSpace,
+	"split":     strings.Split,
+	"join":      func(sep string, a []string) string { return strings.Join(a, sep) },
+	"replace":   func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+	"contains":  func(sub, s string) bool { return strings.Contains(s, sub) },
+	"hasPrefix": func(pre, s string) bool { return strings.HasPrefix(s, pre) },
+	"quote":     strconv.Quote,
+}
+
+// renderTemplates renders every configured template with env and reports
+// whether any destination file changed.
+func renderTemplates(tmpls []configTemplate, env []string) (bool, error) {
+	data := &templateData{Env: envMap(env)}
+	data.App.Name = *name
+	data.App.Home = path.Join(home, *name)
+	data.App.Project = *project
+	data.App.Branch = *branch
+	data.App.SHA = sha
+	data.App.Ref = ref
+
+	changed := false
+	for _, t := range tmpls {
+		c, er := t.render(data)
+		if er != nil {
+			return changed, fmt.Errorf("template %s: %v", t.Src, er)
+		}
+		changed = changed || c
+	}
+	return changed, nil
+}
+
+func (t configTemplate) render(data *templateData) (bool, error) {
+	src := expand(t.Src, data.Env)
+	if !path.IsAbs(src) {
+		src = path.Join(path.Dir(*conf), src)
+	}
+	dest := expand(t.Dest, data.Env)
+	if dest == "" {
+		return false, fmt.Errorf("no dest given")
+	}
+
+	uid, gid, er := t.owner()
+	if er != nil {
+		return false, er
+	}
+	mode := os.FileMode(0644)
+	if t.Mode != nil {
+		mode = os.FileMode(*t.Mode)
+	}
+
+	env := func(k string) string { return data.Env[k] }
+	tmpl, er := template.New(path.Base(src)).Funcs(templateFuncs).Funcs(template.FuncMap{"env": env}).Option("missingkey=zero").ParseFiles(src)
+	if er != nil {
+		return false, er
+	}
+	b := new(bytes.Buffer)
+	if er := tmpl.Execute(b, data); er != nil {
+		return false, er
+	}
+
+	old, er := ioutil.ReadFile(dest)
+	changed := er != nil || !bytes.Equal(old, b.Bytes())
+	if changed {
+		logger.Infof("Rendering %s to %s", src, dest)
+		if er := os.MkdirAll(path.Dir(dest), 0755); er != nil {
+			return false, er
+		}
+		tmp := dest + ".escarole"
+		if er := ioutil.WriteFile(tmp, b.Bytes(), mode); er != nil {
+			return false, er
+		}
+		if er := os.Rename(tmp, dest); er != nil {
+			return false, er
+		}
+	}
+	if er := os.Chmod(dest, mode); er != nil {
+		return changed, er
+	}
+	return changed, os.Chown(dest, uid, gid)
+}
+
+func (t configTemplate) owner() (int, int, error) {
+	if t.Owner == "" {
+		return int(*uid), int(*gid), nil
+	}
+	parts := strings.SplitN(t.Owner, ":", 2)
+	u, er := strconv.Atoi(parts[0])
+	if er != nil {
+		return 0, 0, fmt.Errorf("bad owner %q", t.Owner)
+	}
+	g := int(*gid)
+	if len(parts) > 1 {
+		if g, er = strconv.Atoi(parts[1]); er != nil {
+			return 0, 0, fmt.Errorf("bad owner %q", t.Owner)
+		}
+	}
+	return u, g, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestFileMode(t *testing.T) {
+	tests := []struct {
+		file, body string
+		want       fileMode
+	}{
+		{"a.yml", "templates: [{mode: 640}]", 0640},
+		{"a.yml", "templates: [{mode: 0640}]", 0640},
+		{"a.yml", "templates: [{mode: 0o600}]", 0600},
+		{"a.yml", `templates: [{mode: "0600"}]`, 0600},
+		{"a.json", `{"templates": [{"mode": 755}]}`, 0755},
+		{"a.toml", "[[templates]]\nmode = 0o640", 0640},
+		{"a.toml", "[[templates]]\nmode = 420", 0644},
+		{"a.toml", "[[templates]]\nmode = \"4755\"", 04755},
+	}
+	for _, tt := range tests {
+		c := new(command)
+		if er := decodeConfig(tt.file, []byte(tt.body), c); er != nil {
+			t.Errorf("%s %q: %v", tt.file, tt.body, er)
+			continue
+		}
+		if m := c.Templates[0].Mode; m == nil || *m != tt.want {
+			t.Errorf("%s %q: got %v, want %o", tt.file, tt.body, m, tt.want)
+		}
+	}
+
+	for _, body := range []string{"templates: [{mode: 680}]", "templates: [{mode: rw}]", "templates: [{mode: 17777}]"} {
+		if er := decodeConfig("a.yml", []byte(body), new(command)); er == nil {
+			t.Errorf("%q: expected an error", body)
+		}
+	}
+}
+
+func TestRenderTemplates(t *testing.T) {
+	dir := t.TempDir()
+	home, *name = dir, "app"
+	*uid, *gid = uint32(os.Getuid()), uint32(os.Getgid())
+	*conf = path.Join(dir, "app.yml")
+	os.Setenv("ESCAROLE_TEST_VAR", "escarole")
+	defer os.Unsetenv("ESCAROLE_TEST_VAR")
+
+	src := path.Join(dir, "conf.tmpl")
+	body := `{{ env "ESCAROLE_TEST_VAR" }} {{ .Env.PORT }} {{ default "x" .Env.NONE }} {{ .App.Name }}`
+	if er := ioutil.WriteFile(src, []byte(body), 0644); er != nil {
+		t.Fatal(er)
+	}
+	mode := fileMode(0600)
+	tmpls := []configTemplate{{Src: "conf.tmpl", Dest: "${OUT}/conf", Mode: &mode}}
+	env := []string{"ESCAROLE_TEST_VAR=app", "PORT=80", "OUT=" + dir + "/out"}
+
+	changed, er := renderTemplates(tmpls, env)
+	if er != nil || !changed {
+		t.Fatalf("first render: changed %v, %v", changed, er)
+	}
+	dest := path.Join(dir, "out/conf")
+	b, _ := ioutil.ReadFile(dest)
+	if string(b) != "app 80 x app" {
+		t.Errorf("got %q", b)
+	}
+	if st, er := os.Stat(dest); er != nil || st.Mode().Perm() != 0600 {
+		t.Errorf("got mode %v, %v", st.Mode(), er)
+	}
+
+	if changed, er := renderTemplates(tmpls, env); er != nil || changed {
+		t.Errorf("second render: changed %v, %v", changed, er)
+	}
+}
+
+func TestReloadKeepsConfigOnError(t *testing.T) {
+	dir := t.TempDir()
+	home, *name = dir, "app"
+	*uid, *gid = uint32(os.Getuid()), uint32(os.Getgid())
+	*conf = path.Join(dir, "app.yml")
+
+	body := "cmd: /bin/sh\ntemplates: [{src: missing.tmpl, dest: " + dir + "/out}]\n"
+	if er := ioutil.WriteFile(*conf, []byte(body), 0644); er != nil {
+		t.Fatal(er)
+	}
+	old := &command{Cmd: "/bin/true"}
+	cfg = old
+	defer func() { cfg = new(command) }()
+
+	if next, er := reloadApp(context.Background()); er == nil || !strings.Contains(er.Error(), "missing.tmpl") || next != nil {
+		t.Fatalf("got %v, %v", next, er)
+	}
+	if cfg != old {
+		t.Errorf("config swapped in spite of the failed render")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/units"
+)
+
+// byteSize accepts either a plain number of bytes or a size like "512MB".
+type byteSize int64
+
+func (b *byteSize) UnmarshalJSON(d []byte) error {
+	var s string
+	if er := json.Unmarshal(d, &s); er != nil {
+		s = string(d)
+	}
+	if n, er := strconv.ParseInt(s, 10, 64); er == nil {
+		*b = byteSize(n)
+		return nil
+	}
+	n, er := units.ParseBase2Bytes(s)
+	if er != nil {
+		return fmt.Errorf("bad size %q: %v", s, er)
+	}
+	*b = byteSize(n)
+	return nil
+}
+
+// fileMode is an octal mode like "0640". A bare number is read as octal too,
+// so 640 is 0640.
+type fileMode uint32
+
+func (m *fileMode) UnmarshalJSON(d []byte) error {
+	var s string
+	if er := json.Unmarshal(d, &s); er != nil {
+		s = string(d)
+	}
+	n, er := strconv.ParseUint(strings.TrimPrefix(s, "0o"), 8, 32)
+	if er != nil || n > 07777 {
+		return fmt.Errorf("bad mode %q", s)
+	}
+	*m = fileMode(n)
+	return nil
+}
+
+// duration accepts anything time.ParseDuration does.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if er := json.Unmarshal(b, &s); er != nil {
+		return fmt.Errorf("bad duration %s", b)
+	}
+	v, er := time.ParseDuration(s)
+	if er != nil {
+		return er
+	}
+	*d = duration(v)
+	return nil
+}
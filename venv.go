@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/albertrdixon/gearbox/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	venvLink  = "venv"
+	venvsDir  = "venvs"
+	venvReady = ".escarole-ready"
+	venvKeep  = 2
+)
+
+// venvPath is the virtualenv the app runs with, a link to the one built for
+// the checked out dependencies.
+func venvPath() string {
+	return path.Join(stateDir(), venvLink)
+}
+
+// venvKey identifies a virtualenv by the dependency files in the checkout at
+// dir and the install commands that went into it. One with the app itself
+// installed holds the code of head, so head is part of its key.
+func (b *build) venvKey(t *projectType, dir, head string) (string, error) {
+	paths := b.Paths
+	if len(paths) < 1 {
+		paths = t.deps
+	}
+	out, er := gitOutput("-C", dir, "ls-files", "-z")
+	if er != nil {
+		return "", er
+	}
+	files := []string{}
+	for _, f := range splitNUL(out) {
+		if matchPaths(paths, f) {
+			files = append(files, f)
+		}
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, c := range b.Install {
+		h.Write([]byte(c + "\n"))
+	}
+	if b.installsApp(dir) {
+		h.Write([]byte(head + "\n"))
+	}
+	for _, f := range files {
+		b, er := ioutil.ReadFile(path.Join(dir, f))
+		if er != nil {
+			return "", er
+		}
+		h.Write([]byte(f + "\n"))
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12], nil
+}
+
+// installsApp tells whether the default install puts the app itself into
+// the virtualenv, as it does for setup.py and pyproject.toml apps without a
+// requirements.txt.
+func (b *build) installsApp(dir string) bool {
+	return len(b.Install) < 1 && !exists(path.Join(dir, "requirements.txt"))
+}
+
+// venvInstall returns the commands building the virtualenv venv for the
+// checkout at dir.
+func (b *build) venvInstall(venv, dir string) []string {
+	if len(b.Install) > 0 {
+		return b.Install
+	}
+	cmds := []string{"python3 -m venv " + venv}
+	if !b.installsApp(dir) {
+		return append(cmds, "pip install -r "+path.Join(dir, "requirements.txt"))
+	}
+	return append(cmds, "pip install "+dir)
+}
+
+// syncVenv points the app's virtualenv at the one for the dependencies
+// checked out for head, building it first if there is none yet. Earlier
+// ones are kept around so a rollback finds its virtualenv ready.
+func syncVenv(b *build, t *projectType, c context.Context, head string) error {
+	dir, er := buildVenv(b, t, c, path.Join(home, *name), head)
+	if er != nil {
+		return er
+	}
+
+	if cur, _ := os.Readlink(venvPath()); cur != dir {
+		logger.Infof("Switching virtualenv to %s", path.Base(dir))
+		tmp := venvPath() + ".new"
+		os.Remove(tmp)
+		if er := os.Symlink(dir, tmp); er != nil {
+			return er
+		}
+		if er := os.Rename(tmp, venvPath()); er != nil {
+			return er
+		}
+	}
+	pruneVenvs(path.Dir(dir), b.Keep)
+	return nil
+}
+
+// buildVenv returns the virtualenv for the dependencies in the checkout at
+// src, building it if there is none yet.
+func buildVenv(b *build, t *projectType, c context.Context, src, head string) (string, error) {
+	key, er := b.venvKey(t, src, head)
+	if er != nil {
+		return "", er
+	}
+	root := path.Join(stateDir(), venvsDir)
+	dir := path.Join(root, key)
+
+	if !exists(path.Join(dir, venvReady)) {
+		if er := os.RemoveAll(dir); er != nil {
+			return "", er
+		}
+		if er := os.MkdirAll(root, 0755); er != nil {
+			return "", er
+		}
+		if er := os.Chown(root, int(*uid), int(*gid)); er != nil {
+			return "", er
+		}
+
+		logEvent("info", "venv", "Building virtualenv %s for %s", key, short(head))
+		e, er := cfg.Env.compose()
+		if er != nil {
+			return "", er
+		}
+		env := envMap(e)
+		prependPath(env, path.Join(dir, "bin"))
+		e = append(e, "APP_HOME="+src, "APP_SHA="+head, "VIRTUAL_ENV="+dir, "PATH="+env["PATH"])
+
+		for _, cmd := range b.venvInstall(dir, src) {
+			logger.Infof("Running %q", cmd)
+			r := &rule{Run: cmd, root: src}
+			if er := r.run(c, e); er != nil {
+				os.RemoveAll(dir)
+				return "", er
+			}
+		}
+		if er := ioutil.WriteFile(path.Join(dir, venvReady), []byte(head+"\n"), 0644); er != nil {
+			return "", er
+		}
+	}
+
+	// The ready file's mtime tells when the virtualenv was last used.
+	now := time.Now()
+	os.Chtimes(path.Join(dir, venvReady), now, now)
+	return dir, nil
+}
+
+// pruneVenvs removes all but the keep most recently used virtualenvs.
+func pruneVenvs(root string, keep int) {
+	if keep < 1 {
+		keep = venvKeep
+	}
+	list, er := ioutil.ReadDir(root)
+	if er != nil {
+		return
+	}
+	type used struct {
+		dir string
+		at  time.Time
+	}
+	var venvs []used
+	for _, fi := range list {
+		dir := path.Join(root, fi.Name())
+		if st, er := os.Stat(path.Join(dir, venvReady)); er == nil {
+			venvs = append(venvs, used{dir, st.ModTime()})
+		}
+	}
+	sort.Slice(venvs, func(i, j int) bool { return venvs[i].at.After(venvs[j].at) })
+	for i := keep; i < len(venvs); i++ {
+		logger.Infof("Removing virtualenv %s", path.Base(venvs[i].dir))
+		if er := os.RemoveAll(venvs[i].dir); er != nil {
+			logger.Warnf("Unable to remove %s: %v", venvs[i].dir, er)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestVenvKey(t *testing.T) {
+	testRepo(t)
+	py := projectTypes[0]
+	b := new(build)
+	dir := path.Join(home, *name)
+
+	// A setup.py app is installed into the virtualenv, so each sha has its own.
+	first := commitFile(t, "setup.py", "setup()")
+	second := commitFile(t, "main.py", "v2")
+	k1, er := b.venvKey(py, dir, first)
+	if er != nil {
+		t.Fatal(er)
+	}
+	if k2, _ := b.venvKey(py, dir, second); k1 == k2 {
+		t.Errorf("setup.py: same key for %.7s and %.7s", first, second)
+	}
+
+	// With requirements only the dependency files count.
+	third := commitFile(t, "requirements.txt", "flask")
+	fourth := commitFile(t, "main.py", "v3")
+	k3, _ := b.venvKey(py, dir, third)
+	if k4, _ := b.venvKey(py, dir, fourth); k3 != k4 {
+		t.Errorf("requirements: key changed without the dependencies changing")
+	}
+	fifth := commitFile(t, "requirements dev.txt", "pytest")
+	if k5, _ := b.venvKey(py, dir, fifth); k5 == k3 {
+		t.Errorf("requirements: key kept when requirements dev.txt was added")
+	}
+
+	b.Install = []string{"make venv"}
+	if k6, _ := b.venvKey(py, dir, fifth); k6 == k3 {
+		t.Errorf("install commands are not part of the key")
+	}
+}
+
+func TestVenvInstall(t *testing.T) {
+	dir := t.TempDir()
+	b := new(build)
+	want := []string{"python3 -m venv /v", "pip install " + dir}
+	if got := b.venvInstall("/v", dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("setup.py: got %v", got)
+	}
+	os.WriteFile(path.Join(dir, "requirements.txt"), nil, 0644)
+	want = []string{"python3 -m venv /v", "pip install -r " + path.Join(dir, "requirements.txt")}
+	if got := b.venvInstall("/v", dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("requirements: got %v", got)
+	}
+	b.Install = []string{"make venv"}
+	if got := b.venvInstall("/v", dir); !reflect.DeepEqual(got, b.Install) {
+		t.Errorf("install: got %v", got)
+	}
+}
+
+func TestBuildVenv(t *testing.T) {
+	head := testRepo(t)
+	cfg = new(command)
+	src := path.Join(home, *name)
+	b := &build{Install: []string{"mkdir -p ${VIRTUAL_ENV}", "touch built"}}
+
+	dir, er := buildVenv(b, projectTypes[0], context.Background(), src, head)
+	if er != nil {
+		t.Fatal(er)
+	}
+	if !exists(path.Join(src, "built")) || !exists(path.Join(dir, venvReady)) {
+		t.Fatalf("virtualenv %s not built", dir)
+	}
+
+	// A virtualenv that is ready is used as is.
+	os.Remove(path.Join(src, "built"))
+	if again, er := buildVenv(b, projectTypes[0], context.Background(), src, head); er != nil || again != dir {
+		t.Fatalf("got %s, %v", again, er)
+	}
+	if exists(path.Join(src, "built")) {
+		t.Errorf("ready virtualenv built again")
+	}
+}
+
+func TestPruneVenvs(t *testing.T) {
+	root := t.TempDir()
+	for i, n := range []string{"a", "b", "c"} {
+		dir := path.Join(root, n)
+		os.MkdirAll(dir, 0755)
+		os.WriteFile(path.Join(dir, venvReady), nil, 0644)
+		at := time.Now().Add(time.Duration(i) * time.Hour)
+		os.Chtimes(path.Join(dir, venvReady), at, at)
+	}
+	os.Mkdir(path.Join(root, "broken"), 0755)
+
+	pruneVenvs(root, 2)
+	list, _ := os.ReadDir(root)
+	var left []string
+	for _, e := range list {
+		left = append(left, e.Name())
+	}
+	if want := []string{"b", "broken", "c"}; !reflect.DeepEqual(left, want) {
+		t.Errorf("left %v, want %v", left, want)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/albertrdixon/gearbox/logger"
+)
+
+// verification lists the keys a deployed commit or tag must be signed with.
+type verification struct {
+	Keyring        string `json:"gpg_keyring"`
+	AllowedSigners string `json:"allowed_signers"`
+	Tags           bool   `json:"tags"`
+}
+
+// unverified is returned for a sha that must not be deployed.
+type unverified struct {
+	sha    string
+	reason string
+}
+
+func (u *unverified) Error() string {
+	return fmt.Sprintf("refusing %s: %s", short(u.sha), u.reason)
+}
+
+func (v *verification) enabled() bool {
+	return v != nil && (v.Keyring != "" || v.AllowedSigners != "")
+}
+
+// verify checks sha, or a tag pointing at it, is signed by a trusted key.
+func (v *verification) verify(sha string) error {
+	if !v.enabled() {
+		return nil
+	}
+	env, er := v.gpgHome()
+	if er != nil {
+		return er
+	}
+	cfg := []string{}
+	if v.AllowedSigners != "" {
+		cfg = append(cfg, "-c", "gpg.ssh.allowedSignersFile="+v.AllowedSigners)
+	}
+
+	if !v.Tags {
+		if _, er := gitOutputEnv(env, append(cfg, "verify-commit", sha)...); er != nil {
+			return &unverified{sha, "no trusted signature on commit"}
+		}
+		logger.Infof("Commit %s has a trusted signature", short(sha))
+		return nil
+	}
+
+	tags, er := gitOutput("tag", "--points-at", sha)
+	if er != nil {
+		return er
+	}
+	for _, t := range strings.Fields(tags) {
+		if _, er := gitOutputEnv(env, append(cfg, "verify-tag", t)...); er == nil {
+			logger.Infof("Tag %s on %s has a trusted signature", t, short(sha))
+			return nil
+		}
+		logger.Warnf("Tag %s on %s has no trusted signature", t, short(sha))
+	}
+	return &unverified{sha, "no tag with a trusted signature"}
+}
+
+// gpgHome imports the keyring into a gpg home of its own, so only its keys
+// are trusted, and returns the env pointing git at it.
+func (v *verification) gpgHome() ([]string, error) {
+	dir := path.Join(stateDir(), "gnupg")
+	env := []string{"GNUPGHOME=" + dir}
+	if v.Keyring == "" {
+		return env, nil
+	}
+
+	if er := os.RemoveAll(dir); er != nil {
+		return nil, er
+	}
+	if er := os.MkdirAll(dir, 0700); er != nil {
+		return nil, er
+	}
+	if er := os.Chown(dir, int(*uid), int(*gid)); er != nil {
+		return nil, er
+	}
+
+	cmd := exec.Command("gpg", "--batch", "--quiet", "--import", v.Keyring)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: *uid, Gid: *gid},
+	}
+	if out, er := cmd.CombinedOutput(); er != nil {
+		return nil, fmt.Errorf("importing %s: %v: %s", v.Keyring, er, strings.TrimSpace(string(out)))
+	}
+	return env, nil
+}
+
+// check makes sure the configured key files are usable.
+func (v *verification) check() error {
+	if v == nil {
+		return nil
+	}
+	if !v.enabled() {
+		return errors.New("no gpg_keyring or allowed_signers given")
+	}
+	for _, f := range []string{v.Keyring, v.AllowedSigners} {
+		if f == "" {
+			continue
+		}
+		if _, er := os.Stat(f); er != nil {
+			return er
+		}
+	}
+	if v.Keyring != "" {
+		if _, er := exec.LookPath("gpg"); er != nil {
+			return fmt.Errorf("gpg_keyring needs gpg: %v", er)
+		}
+	}
+	return nil
+}
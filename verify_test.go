@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+// sshSigner makes an ssh key and the allowed signers file trusting it, and
+// returns the git env that signs commits and tags with it.
+func sshSigner(t *testing.T) (allowed string, env []string) {
+	t.Helper()
+	if _, er := exec.LookPath("ssh-keygen"); er != nil {
+		t.Skip("no ssh-keygen")
+	}
+	dir := t.TempDir()
+	key := path.Join(dir, "key")
+	if out, er := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", key).CombinedOutput(); er != nil {
+		t.Fatalf("%v: %s", er, out)
+	}
+	pub, er := os.ReadFile(key + ".pub")
+	if er != nil {
+		t.Fatal(er)
+	}
+	allowed = path.Join(dir, "allowed_signers")
+	if er := os.WriteFile(allowed, []byte("test@example.com "+string(pub)), 0644); er != nil {
+		t.Fatal(er)
+	}
+	return allowed, []string{
+		"GIT_CONFIG_COUNT=2",
+		"GIT_CONFIG_KEY_0=gpg.format", "GIT_CONFIG_VALUE_0=ssh",
+		"GIT_CONFIG_KEY_1=user.signingkey", "GIT_CONFIG_VALUE_1=" + key,
+	}
+}
+
+func TestVerifyCommit(t *testing.T) {
+	unsigned := testRepo(t)
+	allowed, env := sshSigner(t)
+	signed := commitFile(t, "a", "signed", append(env, "GIT_CONFIG_COUNT=3", "GIT_CONFIG_KEY_2=commit.gpgsign", "GIT_CONFIG_VALUE_2=true")...)
+
+	v := &verification{AllowedSigners: allowed}
+	if er := v.verify(signed); er != nil {
+		t.Errorf("signed commit: %v", er)
+	}
+	er := v.verify(unsigned)
+	if _, ok := er.(*unverified); !ok {
+		t.Errorf("unsigned commit: got %v", er)
+	}
+
+	// Without a verify section anything goes.
+	if er := (*verification)(nil).verify(unsigned); er != nil {
+		t.Errorf("no verification: %v", er)
+	}
+}
+
+func TestVerifyTag(t *testing.T) {
+	testRepo(t)
+	allowed, env := sshSigner(t)
+	head := commitFile(t, "a", "tagged")
+	v := &verification{AllowedSigners: allowed, Tags: true}
+
+	if _, ok := v.verify(head).(*unverified); !ok {
+		t.Error("untagged commit passed")
+	}
+	mustGit(t, "tag", "-a", "-m", "plain", "v1")
+	if _, ok := v.verify(head).(*unverified); !ok {
+		t.Error("commit with an unsigned tag passed")
+	}
+	if _, er := gitOutputEnv(env, "tag", "-s", "-m", "signed", "v2"); er != nil {
+		t.Fatal(er)
+	}
+	if er := v.verify(head); er != nil {
+		t.Errorf("signed tag: %v", er)
+	}
+}
+
+func TestVerifyCheck(t *testing.T) {
+	if er := (*verification)(nil).check(); er != nil {
+		t.Errorf("no verify section: %v", er)
+	}
+	if er := (&verification{Tags: true}).check(); er == nil {
+		t.Error("no keys: expected an error")
+	}
+	if er := (&verification{AllowedSigners: "/nonexistent"}).check(); er == nil {
+		t.Error("missing allowed_signers: expected an error")
+	}
+}
+
+func TestVerifyBadKeyring(t *testing.T) {
+	head := testRepo(t)
+	if _, er := exec.LookPath("gpg"); er != nil {
+		t.Skip("no gpg")
+	}
+	keyring := path.Join(t.TempDir(), "trusted.gpg")
+	if er := os.WriteFile(keyring, []byte("not a key"), 0644); er != nil {
+		t.Fatal(er)
+	}
+	er := (&verification{Keyring: keyring}).verify(head)
+	if er == nil || !strings.Contains(er.Error(), "importing") {
+		t.Errorf("got %v", er)
+	}
+}